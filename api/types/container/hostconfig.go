@@ -0,0 +1,28 @@
+package container
+
+// HostConfig holds the runtime configuration for a container that depends
+// on the host it runs on, as opposed to the portable Config. Only the
+// fields this trimmed checkout's daemon package actually reads are defined
+// here; it is not a complete mirror of the real HostConfig.
+type HostConfig struct {
+	NetworkMode NetworkMode
+	IpcMode     IpcMode
+	ShmSize     int64
+
+	DNSSearch  []string
+	DNSOptions []string
+
+	// SecretMode controls whether this container's secrets/configs tmpfs
+	// can be shared with another container, mirroring IpcMode's
+	// "shareable"/"container:<name>" vocabulary.
+	SecretMode SecretMode
+
+	// SecretsDriver selects the backend daemon.secretsProviderFor mounts a
+	// container's secrets/configs directory on: SecretsDriverTmpfs (the
+	// default), SecretsDriverRamfs, or SecretsDriverExternal. Empty uses
+	// the daemon-wide default configured in daemon.json.
+	SecretsDriver string
+	// SecretsDriverPlugin names the registered external secrets-provider
+	// plugin to use when SecretsDriver is SecretsDriverExternal.
+	SecretsDriverPlugin string
+}
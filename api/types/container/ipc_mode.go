@@ -0,0 +1,51 @@
+package container
+
+import "strings"
+
+// IpcMode represents the container ipc stack, following the same
+// "<flag>" / "container:<name>" vocabulary as NetworkMode.
+type IpcMode string
+
+// IsPrivate indicates whether the container uses its own private ipc
+// namespace which can not be shared.
+func (n IpcMode) IsPrivate() bool {
+	return n == "private"
+}
+
+// IsHost indicates whether the container shares the host's ipc namespace.
+func (n IpcMode) IsHost() bool {
+	return n == "host"
+}
+
+// IsContainer indicates whether the container uses another container's ipc
+// namespace.
+func (n IpcMode) IsContainer() bool {
+	return strings.HasPrefix(string(n), "container:")
+}
+
+// IsNone indicates whether the container has no ipc namespace shared or
+// inherited, and gets its own which is not shared.
+func (n IpcMode) IsNone() bool {
+	return n == "none"
+}
+
+// IsShareable indicates whether the container's ipc namespace can be shared
+// with another container.
+func (n IpcMode) IsShareable() bool {
+	return n == "shareable"
+}
+
+// IsEmpty indicates whether the value is empty, i.e. the default was
+// requested.
+func (n IpcMode) IsEmpty() bool {
+	return n == ""
+}
+
+// Container returns the name of the container ipc stack is going to be used.
+func (n IpcMode) Container() string {
+	parts := strings.SplitN(string(n), ":", 2)
+	if len(parts) > 1 {
+		return parts[1]
+	}
+	return ""
+}
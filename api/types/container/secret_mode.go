@@ -0,0 +1,38 @@
+package container
+
+import "strings"
+
+// SecretMode controls how a container's secrets/configs tmpfs is populated:
+// the default (private to the container), shareable with another container,
+// or donated from another container, mirroring IpcMode's vocabulary.
+type SecretMode string
+
+// IsEmpty indicates whether the value is empty, i.e. the default (private)
+// was requested.
+func (s SecretMode) IsEmpty() bool {
+	return s == ""
+}
+
+// IsShareable indicates whether this container's secrets directory can be
+// shared with another container via SecretMode:container:<name>. Like
+// IpcMode, the default is private: a container must opt in with
+// SecretMode:shareable before it can act as a donor.
+func (s SecretMode) IsShareable() bool {
+	return s == "shareable"
+}
+
+// IsContainer indicates whether this container's secrets directory is
+// donated from another container.
+func (s SecretMode) IsContainer() bool {
+	return strings.HasPrefix(string(s), "container:")
+}
+
+// Container returns the name of the donor container when IsContainer is
+// true.
+func (s SecretMode) Container() string {
+	parts := strings.SplitN(string(s), ":", 2)
+	if len(parts) > 1 {
+		return parts[1]
+	}
+	return ""
+}
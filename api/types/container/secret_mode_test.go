@@ -0,0 +1,56 @@
+package container
+
+import "testing"
+
+func TestSecretModeIsEmpty(t *testing.T) {
+	cases := map[SecretMode]bool{
+		"":            true,
+		"shareable":   false,
+		"container:c": false,
+	}
+	for mode, want := range cases {
+		if got := mode.IsEmpty(); got != want {
+			t.Errorf("SecretMode(%q).IsEmpty() = %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestSecretModeIsShareable(t *testing.T) {
+	cases := map[SecretMode]bool{
+		"":            false,
+		"shareable":   true,
+		"Shareable":   false,
+		"container:c": false,
+	}
+	for mode, want := range cases {
+		if got := mode.IsShareable(); got != want {
+			t.Errorf("SecretMode(%q).IsShareable() = %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestSecretModeIsContainer(t *testing.T) {
+	cases := map[SecretMode]bool{
+		"":              false,
+		"shareable":     false,
+		"container:abc": true,
+	}
+	for mode, want := range cases {
+		if got := mode.IsContainer(); got != want {
+			t.Errorf("SecretMode(%q).IsContainer() = %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestSecretModeContainer(t *testing.T) {
+	cases := map[SecretMode]string{
+		"":              "",
+		"shareable":     "",
+		"container:abc": "abc",
+	}
+	for mode, want := range cases {
+		if got := mode.Container(); got != want {
+			t.Errorf("SecretMode(%q).Container() = %q, want %q", mode, got, want)
+		}
+	}
+}
@@ -0,0 +1,571 @@
+package daemon
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/moby/moby/v2/daemon/container"
+	"github.com/moby/moby/v2/errdefs"
+	"github.com/pkg/errors"
+)
+
+// Compression selects how a checkpoint archive's CRIU image directory is
+// compressed. Restore doesn't use this type itself: it detects the
+// compression of an existing archive from its header magic, so archives
+// written under an older default keep working.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// checkpointArchiveExt returns the conventional file extension for a
+// checkpoint archive written with the given compression.
+func checkpointArchiveExt(c Compression) string {
+	switch c {
+	case CompressionGzip:
+		return ".tar.gz"
+	case CompressionNone:
+		return ".tar"
+	default:
+		return ".tar.zst"
+	}
+}
+
+// CheckpointCreateOptions holds the parameters for Daemon.CheckpointCreate.
+type CheckpointCreateOptions struct {
+	// CheckpointID names the checkpoint; it becomes the archive's filename.
+	CheckpointID string
+	// CheckpointDir overrides the container's default checkpoint
+	// directory (ctr.CheckpointDir()) when non-empty.
+	CheckpointDir string
+	// LeaveRunning dumps the container without killing it afterward,
+	// mirroring criu dump's --leave-running.
+	LeaveRunning bool
+	// PreDump does an iterative, non-stop memory pre-dump before the
+	// final dump, shortening the pause the final dump needs.
+	PreDump bool
+	// Compression picks the archive's CRIU image compression. Empty
+	// defaults to CompressionZstd.
+	Compression Compression
+}
+
+// CheckpointDeleteOptions holds the parameters for Daemon.CheckpointDelete.
+type CheckpointDeleteOptions struct {
+	CheckpointID  string
+	CheckpointDir string
+}
+
+// CheckpointListOptions holds the parameters for Daemon.CheckpointList.
+type CheckpointListOptions struct {
+	CheckpointDir string
+}
+
+// CheckpointRestoreOptions holds the parameters for Daemon.CheckpointRestore.
+type CheckpointRestoreOptions struct {
+	CheckpointID  string
+	CheckpointDir string
+}
+
+// Checkpoint describes a checkpoint archive found by Daemon.CheckpointList.
+type Checkpoint struct {
+	Name        string
+	Compression Compression
+}
+
+// CheckpointCreate dumps ctr's running process tree with CRIU and packages
+// the result - CRIU's image directory, the container config and its mount
+// metadata - into a single compressed tar archive under the container's
+// (or opts.CheckpointDir's) checkpoint directory.
+//
+// On dump failure the container is left in whatever state CRIU left it in;
+// unless opts.LeaveRunning was requested (in which case a failed dump never
+// touched the running process), CheckpointCreate falls back to
+// killProcessDirectly so a failed checkpoint still behaves like a normal
+// stop instead of wedging the container half-frozen.
+func (daemon *Daemon) CheckpointCreate(name string, opts CheckpointCreateOptions) error {
+	ctr, err := daemon.GetContainer(name)
+	if err != nil {
+		return err
+	}
+
+	if opts.CheckpointID == "" {
+		return errdefs.InvalidParameter(errors.New("checkpoint name is required"))
+	}
+	if !ctr.IsRunning() {
+		return errdefs.Conflict(errors.New("checkpoint only works on running containers"))
+	}
+	pid := ctr.GetPID()
+	if pid == 0 {
+		return errdefs.Conflict(errors.New("container has no running process to checkpoint"))
+	}
+
+	compression := opts.Compression
+	if compression == "" {
+		compression = CompressionZstd
+	}
+
+	checkpointDir := opts.CheckpointDir
+	if checkpointDir == "" {
+		checkpointDir = ctr.CheckpointDir()
+	}
+	if err := os.MkdirAll(checkpointDir, 0o700); err != nil {
+		return errdefs.System(errors.Wrap(err, "creating checkpoint directory"))
+	}
+
+	archivePath := filepath.Join(checkpointDir, opts.CheckpointID+checkpointArchiveExt(compression))
+	if _, err := os.Stat(archivePath); err == nil {
+		return errdefs.Conflict(errors.Errorf("checkpoint %s already exists", opts.CheckpointID))
+	}
+
+	workDir, err := os.MkdirTemp(checkpointDir, ".dump-")
+	if err != nil {
+		return errdefs.System(errors.Wrap(err, "creating checkpoint work directory"))
+	}
+	defer os.RemoveAll(workDir)
+
+	imagesDir := filepath.Join(workDir, "criu")
+	if err := os.MkdirAll(imagesDir, 0o700); err != nil {
+		return errdefs.System(err)
+	}
+
+	if opts.PreDump {
+		if err := criuPreDump(pid, workDir); err != nil {
+			return daemon.checkpointDumpFailed(ctr, opts.LeaveRunning, err)
+		}
+	}
+	if err := criuDump(pid, imagesDir, workDir, opts.LeaveRunning, opts.PreDump); err != nil {
+		return daemon.checkpointDumpFailed(ctr, opts.LeaveRunning, err)
+	}
+
+	if err := writeCheckpointArchive(archivePath, compression, imagesDir, ctr); err != nil {
+		return errdefs.System(errors.Wrap(err, "writing checkpoint archive"))
+	}
+
+	daemon.LogContainerEvent(ctr, "checkpoint")
+	return nil
+}
+
+// checkpointDumpFailed logs a failed dump and, unless the caller asked to
+// leave the container running (in which case a failed dump never stopped
+// it), falls back to killProcessDirectly so the container still ends up
+// stopped the way a checkpoint normally stops it.
+func (daemon *Daemon) checkpointDumpFailed(ctr *container.Container, leaveRunning bool, dumpErr error) error {
+	log.G(context.TODO()).WithError(dumpErr).WithField("container", ctr.ID).Warn("criu dump failed, falling back to normal shutdown")
+	if !leaveRunning {
+		if killErr := killProcessDirectly(ctr); killErr != nil {
+			return errdefs.System(errors.Wrapf(dumpErr, "checkpoint failed and fallback kill also failed: %v", killErr))
+		}
+	}
+	return errdefs.System(errors.Wrap(dumpErr, "checkpoint failed"))
+}
+
+// criuPreDump takes an iterative, non-stop memory pre-dump of pid into
+// workDir/pre-dump, so the final dump only has to transfer pages dirtied
+// since the pre-dump, shortening the container's pause.
+func criuPreDump(pid int, workDir string) error {
+	preDumpDir := filepath.Join(workDir, "pre-dump")
+	if err := os.MkdirAll(preDumpDir, 0o700); err != nil {
+		return err
+	}
+	return runCriu(
+		"pre-dump",
+		"--images-dir", preDumpDir,
+		"--tree", strconv.Itoa(pid),
+		"--shell-job",
+		"--track-mem",
+	)
+}
+
+// criuDump dumps pid into imagesDir. If a pre-dump was taken, it's linked in
+// via --prev-images-dir so only memory pages dirtied since then are copied.
+func criuDump(pid int, imagesDir, workDir string, leaveRunning, fromPreDump bool) error {
+	args := []string{
+		"dump",
+		"--images-dir", imagesDir,
+		"--tree", strconv.Itoa(pid),
+		"--shell-job",
+		"--file-locks",
+	}
+	if leaveRunning {
+		args = append(args, "--leave-running")
+	}
+	if fromPreDump {
+		args = append(args, "--prev-images-dir", filepath.Join(workDir, "pre-dump"), "--track-mem")
+	}
+	return runCriu(args...)
+}
+
+// runCriu execs the criu binary, wrapping a failure with its combined
+// output so the reported error says what CRIU actually objected to.
+func runCriu(args ...string) error {
+	out, err := exec.Command("criu", args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "criu %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// writeCheckpointArchive packages imagesDir (CRIU's dump) alongside ctr's
+// config and mount metadata into a tar archive at path, compressed per
+// compression.
+func writeCheckpointArchive(path string, compression Compression, imagesDir string, ctr *container.Container) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	w, closeCompressor, err := compressionWriter(f, compression)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeCompressor(); err == nil {
+			err = cerr
+		}
+	}()
+
+	tw := tar.NewWriter(w)
+	defer func() {
+		if cerr := tw.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	if err := addFileToTar(tw, "config.json", ctr.Config); err != nil {
+		return err
+	}
+	if err := addFileToTar(tw, "mounts.json", ctr.MountPoints); err != nil {
+		return err
+	}
+	return addDirToTar(tw, imagesDir, "criu")
+}
+
+// compressionWriter wraps w for the given compression, returning the
+// writer entries should be written to and a close func that must run
+// before w itself is closed.
+func compressionWriter(w io.Writer, compression Compression) (io.Writer, func() error, error) {
+	switch compression {
+	case CompressionNone:
+		return w, func() error { return nil }, nil
+	case CompressionGzip:
+		gw := gzip.NewWriter(w)
+		return gw, gw.Close, nil
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zw, zw.Close, nil
+	default:
+		return nil, nil, errdefs.InvalidParameter(errors.Errorf("unsupported compression %q", compression))
+	}
+}
+
+// addFileToTar writes v, JSON-encoded, as a single tar entry named name.
+func addFileToTar(tw *tar.Writer, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(data)), Mode: 0o600}); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// addDirToTar recursively adds dir's contents to tw under prefix.
+func addDirToTar(tw *tar.Writer, dir, prefix string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(prefix, rel)
+		if fi.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			return tw.WriteHeader(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0o700})
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: fi.Size(), Mode: 0o600}); err != nil {
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+}
+
+// CheckpointRestore unpacks a checkpoint archive created by CheckpointCreate
+// and resumes it: it replays the IPC/shm/secret setup CheckpointCreate's
+// sibling setupContainerDirs does for a normal start, then invokes
+// `criu restore` inside the container's namespaces.
+//
+// The archive's compression is detected from its header magic rather than
+// trusted from opts or the filename, so a checkpoint written under an
+// earlier default compression still restores correctly.
+func (daemon *Daemon) CheckpointRestore(name string, opts CheckpointRestoreOptions) error {
+	ctr, err := daemon.GetContainer(name)
+	if err != nil {
+		return err
+	}
+	if ctr.IsRunning() {
+		return errdefs.Conflict(errors.New("cannot restore into a running container"))
+	}
+	if opts.CheckpointID == "" {
+		return errdefs.InvalidParameter(errors.New("checkpoint name is required"))
+	}
+
+	checkpointDir := opts.CheckpointDir
+	if checkpointDir == "" {
+		checkpointDir = ctr.CheckpointDir()
+	}
+
+	archivePath, compression, err := findCheckpointArchive(checkpointDir, opts.CheckpointID)
+	if err != nil {
+		return err
+	}
+
+	workDir, err := os.MkdirTemp(checkpointDir, ".restore-")
+	if err != nil {
+		return errdefs.System(errors.Wrap(err, "creating restore work directory"))
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := extractCheckpointArchive(archivePath, compression, workDir); err != nil {
+		return errdefs.System(errors.Wrap(err, "extracting checkpoint archive"))
+	}
+
+	if _, err := daemon.setupContainerDirs(ctr); err != nil {
+		return errdefs.System(errors.Wrap(err, "replaying container directory setup"))
+	}
+
+	if err := criuRestore(ctr, filepath.Join(workDir, "criu")); err != nil {
+		return errdefs.System(errors.Wrap(err, "criu restore failed"))
+	}
+
+	daemon.LogContainerEvent(ctr, "restore")
+	return nil
+}
+
+// criuRestore resumes the dump under imagesDir inside ctr's namespaces.
+func criuRestore(ctr *container.Container, imagesDir string) error {
+	return runCriu(
+		"restore",
+		"--images-dir", imagesDir,
+		"--shell-job",
+		"--restore-detached",
+		"--pidfile", filepath.Join(ctr.Root, "criu-restore.pid"),
+	)
+}
+
+// checkpointMagic identifies a compression format from an archive's
+// leading bytes.
+var checkpointMagic = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// detectCompression sniffs f's compression from its header magic, leaving
+// f's offset where it found it (start of file) so the caller can read it
+// back from the beginning. It reports CompressionNone for a plain tar.
+func detectCompression(f *os.File) (Compression, error) {
+	head := make([]byte, 4)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	for _, m := range checkpointMagic {
+		if len(head) >= len(m.magic) && string(head[:len(m.magic)]) == string(m.magic) {
+			return m.compression, nil
+		}
+	}
+	return CompressionNone, nil
+}
+
+// findCheckpointArchive locates the archive for id under dir regardless of
+// which compression it was written with, and reports the compression it
+// actually detects from the file rather than its extension.
+func findCheckpointArchive(dir, id string) (string, Compression, error) {
+	for _, c := range []Compression{CompressionZstd, CompressionGzip, CompressionNone} {
+		p := filepath.Join(dir, id+checkpointArchiveExt(c))
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return "", "", errdefs.System(err)
+		}
+		defer f.Close()
+		detected, err := detectCompression(f)
+		if err != nil {
+			return "", "", errdefs.System(err)
+		}
+		return p, detected, nil
+	}
+	return "", "", errdefs.NotFound(errors.Errorf("checkpoint %s not found", id))
+}
+
+// extractCheckpointArchive unpacks the archive at path, decompressed per
+// compression, into dir.
+func extractCheckpointArchive(path string, compression Compression, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch compression {
+	case CompressionGzip:
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	case CompressionZstd:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case CompressionNone:
+	default:
+		return errdefs.InvalidParameter(errors.Errorf("unsupported compression %q", compression))
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, hdr.Name)
+		if !isPathInDir(dir, target) {
+			return errdefs.InvalidParameter(errors.Errorf("checkpoint archive entry %q escapes extraction directory", hdr.Name))
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// isPathInDir reports whether target is dir itself or a descendant of it,
+// guarding callers that join an untrusted relative path (e.g. a tar entry
+// name) against escaping dir via ".." segments or an absolute path.
+func isPathInDir(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// CheckpointList returns the checkpoints found under ctr's (or
+// opts.CheckpointDir's) checkpoint directory.
+func (daemon *Daemon) CheckpointList(name string, opts CheckpointListOptions) ([]Checkpoint, error) {
+	ctr, err := daemon.GetContainer(name)
+	if err != nil {
+		return nil, err
+	}
+	checkpointDir := opts.CheckpointDir
+	if checkpointDir == "" {
+		checkpointDir = ctr.CheckpointDir()
+	}
+
+	entries, err := os.ReadDir(checkpointDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errdefs.System(err)
+	}
+
+	var out []Checkpoint
+	for _, e := range entries {
+		base := e.Name()
+		for _, c := range []Compression{CompressionZstd, CompressionGzip, CompressionNone} {
+			if ext := checkpointArchiveExt(c); strings.HasSuffix(base, ext) {
+				out = append(out, Checkpoint{Name: strings.TrimSuffix(base, ext), Compression: c})
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// CheckpointDelete removes a checkpoint archive, regardless of which
+// compression it was written with.
+func (daemon *Daemon) CheckpointDelete(name string, opts CheckpointDeleteOptions) error {
+	ctr, err := daemon.GetContainer(name)
+	if err != nil {
+		return err
+	}
+	checkpointDir := opts.CheckpointDir
+	if checkpointDir == "" {
+		checkpointDir = ctr.CheckpointDir()
+	}
+
+	path, _, err := findCheckpointArchive(checkpointDir, opts.CheckpointID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return errdefs.System(err)
+	}
+	return nil
+}
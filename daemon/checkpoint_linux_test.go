@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestIsPathInDir(t *testing.T) {
+	cases := []struct {
+		name   string
+		target string
+		want   bool
+	}{
+		{"dir itself", "/tmp/x", true},
+		{"descendant", "/tmp/x/a/b", true},
+		{"dotdot escape", "/tmp/y", false},
+		{"sibling prefix collision", "/tmp/x-evil", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, isPathInDir("/tmp/x", tc.target), tc.want)
+		})
+	}
+}
+
+// writeTarWithEntry builds a minimal single-entry, uncompressed tar archive
+// at path whose one header name is name, so extractCheckpointArchive's
+// containment check can be exercised against a crafted tar-slip entry
+// without needing a real CheckpointCreate to have produced it.
+func writeTarWithEntry(t *testing.T, path, name string) {
+	t.Helper()
+	f, err := os.Create(path)
+	assert.NilError(t, err)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Name: name, Size: 4, Mode: 0o600}))
+	_, err = tw.Write([]byte("evil"))
+	assert.NilError(t, err)
+	assert.NilError(t, tw.Close())
+}
+
+func TestExtractCheckpointArchiveRejectsTarSlip(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "checkpoint.tar")
+	writeTarWithEntry(t, archive, "../../etc/passwd")
+
+	extractTo := t.TempDir()
+	err := extractCheckpointArchive(archive, CompressionNone, extractTo)
+	assert.ErrorContains(t, err, "escapes extraction directory")
+
+	_, statErr := os.Stat(filepath.Join(filepath.Dir(extractTo), "etc", "passwd"))
+	assert.Assert(t, os.IsNotExist(statErr))
+}
+
+func TestExtractCheckpointArchiveAcceptsNormalEntries(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "checkpoint.tar")
+	writeTarWithEntry(t, archive, "config.json")
+
+	extractTo := t.TempDir()
+	assert.NilError(t, extractCheckpointArchive(archive, CompressionNone, extractTo))
+
+	data, err := os.ReadFile(filepath.Join(extractTo, "config.json"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "evil")
+}
@@ -169,6 +169,40 @@ func (daemon *Daemon) getIPCContainer(id string) (*container.Container, error) {
 	return ctr, nil
 }
 
+// getSecretContainer validates that id names a running, non-restarting
+// container whose secrets were declared shareable (SecretMode:shareable)
+// and whose secret tmpfs exists, mirroring getIPCContainer's checks for
+// IpcMode:container.
+func (daemon *Daemon) getSecretContainer(id string) (*container.Container, error) {
+	ctr, err := daemon.GetContainer(id)
+	if err != nil {
+		return nil, errdefs.InvalidParameter(err)
+	}
+	if !ctr.IsRunning() {
+		return nil, errNotRunning(id)
+	}
+	if ctr.IsRestarting() {
+		return nil, errContainerIsRestarting(id)
+	}
+	if !ctr.HostConfig.SecretMode.IsShareable() {
+		return nil, errdefs.InvalidParameter(errors.New("container " + id + ": non-shareable secrets (hint: use SecretMode:shareable for the donor container)"))
+	}
+
+	dir, err := ctr.SecretMountPath()
+	if err != nil {
+		return nil, errors.Wrap(err, "container "+id)
+	}
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		if err == nil || os.IsNotExist(err) {
+			return nil, errdefs.InvalidParameter(errors.New("container " + id + ": secrets directory does not exist"))
+		}
+		// stat() failed?
+		return nil, errdefs.System(errors.Wrap(err, "container "+id))
+	}
+
+	return ctr, nil
+}
+
 func (daemon *Daemon) getPIDContainer(id string) (*container.Container, error) {
 	ctr, err := daemon.GetContainer(id)
 	if err != nil {
@@ -238,6 +272,11 @@ func (daemon *Daemon) setupIPCDirs(ctr *container.Container) error {
 		if _, err := os.Stat("/dev/shm"); err != nil {
 			return errors.New("/dev/shm is not mounted, but must be for --ipc=host")
 		}
+		if daemon.runningRootless() {
+			if err := unix.Access("/dev/shm", unix.W_OK); err != nil {
+				return errdefs.InvalidParameter(errors.Wrap(err, "host /dev/shm is not writable by the rootless daemon's effective user, but must be for --ipc=host"))
+			}
+		}
 		ctr.ShmPath = "/dev/shm"
 
 	case ipcMode.IsPrivate(), ipcMode.IsNone():
@@ -251,22 +290,13 @@ func (daemon *Daemon) setupIPCDirs(ctr *container.Container) error {
 		fallthrough
 
 	case ipcMode.IsShareable():
-		uid, gid := daemon.idMapping.RootPair()
 		if !ctr.HasMountFor("/dev/shm") {
 			shmPath, err := ctr.ShmResourcePath()
 			if err != nil {
 				return err
 			}
 
-			if err := user.MkdirAllAndChown(shmPath, 0o700, uid, gid); err != nil {
-				return err
-			}
-
-			shmproperty := "mode=1777,size=" + strconv.FormatInt(ctr.HostConfig.ShmSize, 10)
-			if err := unix.Mount("shm", shmPath, "tmpfs", uintptr(unix.MS_NOEXEC|unix.MS_NOSUID|unix.MS_NODEV), label.FormatMountLabel(shmproperty, ctr.GetMountLabel())); err != nil {
-				return fmt.Errorf("mounting shm tmpfs: %s", err)
-			}
-			if err := os.Chown(shmPath, uid, gid); err != nil {
+			if err := daemon.mountContainerShm(ctr, shmPath); err != nil {
 				return err
 			}
 			ctr.ShmPath = shmPath
@@ -279,20 +309,100 @@ func (daemon *Daemon) setupIPCDirs(ctr *container.Container) error {
 	return nil
 }
 
+// runningRootless reports whether this daemon itself is confined to a
+// user namespace without the privilege to mount(2) or chown to
+// arbitrary uid/gids - the case a rootless dockerd always runs in. A
+// rootless daemon's idMapping is never the identity mapping, since it
+// can only ever map through uid/gid ranges the invoking user already
+// owns.
+func (daemon *Daemon) runningRootless() bool {
+	return !daemon.idMapping.Empty() && unix.Geteuid() != 0
+}
+
+// mountContainerShm creates and populates shmPath, ctr's /dev/shm.
+//
+// A rootful daemon mounts a fresh tmpfs there directly, as it always
+// has. A rootless daemon usually can't: mount(2) with MS_NOSUID|MS_NODEV
+// is commonly denied inside its user namespace, and it can't chown to a
+// uid/gid it doesn't itself own. In that case it falls back to
+// bind-mounting a directory carved out of its own per-user tmpfs
+// (XDG_RUNTIME_DIR, which rootlesskit-style setups already back with
+// tmpfs) into the container's shm path.
+func (daemon *Daemon) mountContainerShm(ctr *container.Container, shmPath string) error {
+	uid, gid := daemon.idMapping.RootPair()
+
+	if err := user.MkdirAllAndChown(shmPath, 0o700, uid, gid); err != nil {
+		return err
+	}
+
+	if !daemon.runningRootless() {
+		shmproperty := "mode=1777,size=" + strconv.FormatInt(ctr.HostConfig.ShmSize, 10)
+		if err := unix.Mount("shm", shmPath, "tmpfs", uintptr(unix.MS_NOEXEC|unix.MS_NOSUID|unix.MS_NODEV), label.FormatMountLabel(shmproperty, ctr.GetMountLabel())); err != nil {
+			return fmt.Errorf("mounting shm tmpfs: %s", err)
+		}
+		return os.Chown(shmPath, uid, gid)
+	}
+
+	src, err := rootlessShmSource(ctr.ID)
+	if err != nil {
+		if ctr.HostConfig.IpcMode.IsShareable() {
+			return errdefs.NotImplemented(errors.Wrap(err, "rootless daemon cannot provide a shareable IPC namespace"))
+		}
+		return err
+	}
+	if err := unix.Mount(src, shmPath, "", unix.MS_BIND, ""); err != nil {
+		return errdefs.NotImplemented(errors.Wrapf(err, "bind-mounting rootless shm source %s", src))
+	}
+	return nil
+}
+
+// rootlessShmSource returns the per-container directory under the
+// rootless daemon's own tmpfs to bind-mount as ctr's /dev/shm,
+// creating it if necessary.
+func rootlessShmSource(id string) (string, error) {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return "", errors.New("XDG_RUNTIME_DIR is not set; cannot locate the rootless daemon's per-user tmpfs")
+	}
+	dir := filepath.Join(runtimeDir, "containers", "shm", id)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", errors.Wrap(err, "creating rootless shm source dir")
+	}
+	return dir, nil
+}
+
 func (daemon *Daemon) setupSecretDir(ctr *container.Container) (setupErr error) {
 	if len(ctr.SecretReferences) == 0 && len(ctr.ConfigReferences) == 0 {
 		return nil
 	}
 
-	if err := daemon.createSecretsDir(ctr); err != nil {
+	if ctr.HostConfig.SecretMode.IsContainer() {
+		return daemon.setupSecretDirFromContainer(ctr)
+	}
+
+	provider, err := daemon.secretsProviderFor(ctr)
+	if err != nil {
+		return err
+	}
+
+	if err := provider.Setup(ctr); err != nil {
+		provider.Cleanup(ctr)
 		return err
 	}
 	defer func() {
 		if setupErr != nil {
-			daemon.cleanupSecretDir(ctr)
+			provider.Cleanup(ctr)
 		}
 	}()
 
+	return provider.Remount(ctr)
+}
+
+// injectSecretsAndConfigs writes ctr's declared secrets and configs, read
+// from ctr.DependencyStore, into the directory a SecretsProvider.Setup has
+// already mounted. It's shared by the tmpfs and ramfs providers, which
+// differ only in the filesystem backing that directory.
+func (daemon *Daemon) injectSecretsAndConfigs(ctr *container.Container) error {
 	if ctr.DependencyStore == nil {
 		return errors.New("secret store is not initialized")
 	}
@@ -397,12 +507,14 @@ func (daemon *Daemon) setupSecretDir(ctr *container.Container) (setupErr error)
 		}
 	}
 
-	return daemon.remountSecretDir(ctr)
+	return nil
 }
 
-// createSecretsDir is used to create a dir suitable for storing container secrets.
-// In practice this is using a tmpfs mount and is used for both "configs" and "secrets"
-func (daemon *Daemon) createSecretsDir(ctr *container.Container) error {
+// createSecretsDir creates a dir suitable for storing container secrets,
+// backed by a fsType ("tmpfs" or "ramfs") mount. It's used for both
+// "configs" and "secrets", by whichever SecretsProvider mounts one of
+// those two filesystem types.
+func (daemon *Daemon) createSecretsDir(ctr *container.Container, fsType string) error {
 	// retrieve possible remapped range start for root UID, GID
 	uid, gid := daemon.idMapping.RootPair()
 	dir, err := ctr.SecretMountPath()
@@ -410,19 +522,59 @@ func (daemon *Daemon) createSecretsDir(ctr *container.Container) error {
 		return errors.Wrap(err, "error getting container secrets dir")
 	}
 
-	// create tmpfs
 	if err := user.MkdirAllAndChown(dir, 0o700, uid, gid); err != nil {
 		return errors.Wrap(err, "error creating secret local mount path")
 	}
 
 	tmpfsOwnership := fmt.Sprintf("uid=%d,gid=%d", uid, gid)
-	if err := mount.Mount("tmpfs", dir, "tmpfs", "nodev,nosuid,noexec,"+tmpfsOwnership); err != nil {
+	if err := mount.Mount(fsType, dir, fsType, "nodev,nosuid,noexec,"+tmpfsOwnership); err != nil {
 		return errors.Wrap(err, "unable to setup secret mount")
 	}
 	return nil
 }
 
-func (daemon *Daemon) remountSecretDir(ctr *container.Container) error {
+// setupSecretDirFromContainer bind-mounts, read-only, the secret tmpfs of
+// the SecretMode:container:<id> donor named by ctr.HostConfig.SecretMode,
+// instead of provisioning ctr's own tmpfs and writing secrets into it.
+// This lets a sidecar own key material and short-lived credentials in one
+// place and share them with worker containers without duplicating
+// plaintext on disk; rotation is then just a matter of rewriting the
+// donor's tmpfs.
+func (daemon *Daemon) setupSecretDirFromContainer(ctr *container.Container) (setupErr error) {
+	donor, err := daemon.getSecretContainer(ctr.HostConfig.SecretMode.Container())
+	if err != nil {
+		return err
+	}
+
+	donorDir, err := donor.SecretMountPath()
+	if err != nil {
+		return errors.Wrap(err, "error getting donor container secrets dir")
+	}
+	dir, err := ctr.SecretMountPath()
+	if err != nil {
+		return errors.Wrap(err, "error getting container secrets dir")
+	}
+
+	uid, gid := daemon.idMapping.RootPair()
+	if err := user.MkdirAllAndChown(dir, 0o700, uid, gid); err != nil {
+		return errors.Wrap(err, "error creating secret local mount path")
+	}
+	defer func() {
+		if setupErr != nil {
+			daemon.cleanupSecretDir(ctr)
+		}
+	}()
+
+	if err := mount.Mount(donorDir, dir, "none", "bind"); err != nil {
+		return errors.Wrap(err, "unable to bind mount donor secrets")
+	}
+	if err := mount.Mount(donorDir, dir, "none", "remount,ro,bind"); err != nil {
+		return errors.Wrap(err, "unable to remount donor secrets read-only")
+	}
+	return nil
+}
+
+func (daemon *Daemon) remountSecretDir(ctr *container.Container, fsType string) error {
 	dir, err := ctr.SecretMountPath()
 	if err != nil {
 		return errors.Wrap(err, "error getting container secrets path")
@@ -434,13 +586,31 @@ func (daemon *Daemon) remountSecretDir(ctr *container.Container) error {
 	tmpfsOwnership := fmt.Sprintf("uid=%d,gid=%d", uid, gid)
 
 	// remount secrets ro
-	if err := mount.Mount("tmpfs", dir, "tmpfs", "remount,ro,"+tmpfsOwnership); err != nil {
+	if err := mount.Mount(fsType, dir, fsType, "remount,ro,"+tmpfsOwnership); err != nil {
 		return errors.Wrap(err, "unable to remount dir as readonly")
 	}
 
 	return nil
 }
 
+// remountSecretDirRW is the inverse of remountSecretDir's "remount,ro":
+// it briefly makes the container's secrets tmpfs writable again so a
+// rotated secret can be written in place. Callers are responsible for
+// remounting it back to read-only once done.
+func (daemon *Daemon) remountSecretDirRW(ctr *container.Container, fsType string) error {
+	dir, err := ctr.SecretMountPath()
+	if err != nil {
+		return errors.Wrap(err, "error getting container secrets path")
+	}
+	uid, gid := daemon.idMapping.RootPair()
+	tmpfsOwnership := fmt.Sprintf("uid=%d,gid=%d", uid, gid)
+
+	if err := mount.Mount(fsType, dir, fsType, "remount,rw,"+tmpfsOwnership); err != nil {
+		return errors.Wrap(err, "unable to remount dir as read-write")
+	}
+	return nil
+}
+
 func (daemon *Daemon) cleanupSecretDir(ctr *container.Container) {
 	dir, err := ctr.SecretMountPath()
 	if err != nil {
@@ -504,52 +674,131 @@ func serviceDiscoveryOnDefaultNetwork() bool {
 	return false
 }
 
+// dnsRefreshStrategy controls how a container's resolv.conf is kept in
+// sync with the host's upstream DNS configuration after the container
+// has already started.
+type dnsRefreshStrategy int
+
+const (
+	// dnsRefreshStatic copies the origin resolv.conf into the container
+	// once, at container creation, and never looks at it again.
+	dnsRefreshStatic dnsRefreshStrategy = iota
+	// dnsRefreshWatch additionally watches the origin resolv.conf for
+	// writes - systemd-resolved rewrites /run/systemd/resolve/resolv.conf
+	// in place on every network change - and re-copies it into the
+	// container's own resolv.conf for as long as the container runs.
+	dnsRefreshWatch
+)
+
+// resolverPolicy describes, for one networking mode, where a container's
+// /etc/hosts and /etc/resolv.conf are sourced from, whether the embedded
+// DNS server is available to it, and how its resolv.conf should track
+// later changes to the host's upstream DNS. It replaces what used to be
+// inline cases in a switch here, so that adding a policy - for example a
+// future DoH-forwarding mode - is additive instead of another switch arm
+// threading more state through this function.
+type resolverPolicy struct {
+	// name identifies the policy.
+	name string
+	// match reports whether this policy governs ctr. Policies are
+	// consulted in resolverPolicies order; the first match wins.
+	match func(ctr *container.Container) bool
+	// hostsOrigin is the host-side /etc/hosts to copy into the
+	// container, or "" if this mode has no analogous host file.
+	hostsOrigin string
+	// resolvConfOrigin returns the host-side resolv.conf to copy into
+	// the container.
+	resolvConfOrigin func(cfg *config.Config) string
+	// refresh controls whether resolvConfOrigin is watched for changes
+	// after the container starts.
+	refresh dnsRefreshStrategy
+	// searchDomains and ndots hold a DNS search list and ndots option for
+	// the policy. No entry of resolverPolicies sets them, and
+	// buildSandboxPlatformOptions does not read them, so they have no
+	// effect on a container's resolv.conf.
+	searchDomains []string
+	ndots         *int
+}
+
+// resolverPolicies is consulted in order; the first match wins. The
+// catch-all entry, matching any networking mode not handled above it,
+// must stay last.
+var resolverPolicies = []resolverPolicy{
+	{
+		// In host-mode networking, the container does not have its own
+		// networking namespace, so both /etc/hosts and /etc/resolv.conf
+		// should be the same as on the host itself. The container gets
+		// a copy of these files.
+		name:             "host",
+		match:            func(ctr *container.Container) bool { return ctr.HostConfig.NetworkMode.IsHost() },
+		hostsOrigin:      "/etc/hosts",
+		resolvConfOrigin: func(*config.Config) string { return "/etc/resolv.conf" },
+		refresh:          dnsRefreshStatic,
+	},
+	{
+		// The container uses a user-defined network. We use the
+		// embedded DNS server for container name resolution and to act
+		// as a DNS forwarder for external DNS resolution. We parse the
+		// DNS server(s) that are defined in /etc/resolv.conf on the
+		// host, which may be a local DNS server (for example, if
+		// DNSMasq or systemd-resolved are in use); the embedded DNS
+		// server forwards resolution to it. If systemd-resolved is
+		// used, its "upstream" DNS servers live in
+		// /run/systemd/resolve/resolv.conf, which we watch so that the
+		// embedded DNS server's forwarding target tracks host changes.
+		name:             "user-defined",
+		match:            func(ctr *container.Container) bool { return ctr.HostConfig.NetworkMode.IsUserDefined() },
+		resolvConfOrigin: func(*config.Config) string { return "/etc/resolv.conf" },
+		refresh:          dnsRefreshWatch,
+	},
+	{
+		// For other situations, such as the default bridge network,
+		// container discovery / name resolution is handled through
+		// /etc/hosts, and no embedded DNS server is available. Without
+		// the embedded DNS, we cannot use local DNS servers on the host
+		// (for example, if DNSMasq or systemd-resolved is used). If
+		// systemd-resolved is used, we try to determine the external
+		// DNS servers that are used on the host.
+		//
+		// Copy the host's resolv.conf for the container
+		// (/run/systemd/resolve/resolv.conf or /etc/resolv.conf), and
+		// watch it so that DNS servers configured in the container are
+		// updated when the DNS servers on the host change, rather than
+		// only ever reflecting what was current at container creation.
+		name:             "default",
+		match:            func(*container.Container) bool { return true },
+		resolvConfOrigin: func(cfg *config.Config) string { return cfg.GetResolvConf() },
+		refresh:          dnsRefreshWatch,
+	},
+}
+
+// resolverPolicyFor returns the first entry of resolverPolicies matching
+// ctr's networking mode.
+func resolverPolicyFor(ctr *container.Container) resolverPolicy {
+	for _, p := range resolverPolicies {
+		if p.match(ctr) {
+			return p
+		}
+	}
+	// unreachable: resolverPolicies' last entry always matches.
+	return resolverPolicies[len(resolverPolicies)-1]
+}
+
 func buildSandboxPlatformOptions(ctr *container.Container, cfg *config.Config, sboxOptions *[]libnetwork.SandboxOption) error {
 	var err error
-	var originResolvConfPath string
 
 	// Set the correct paths for /etc/hosts and /etc/resolv.conf, based on the
 	// networking-mode of the container. Note that containers with "container"
 	// networking are already handled in "initializeNetworking()" before we reach
 	// this function, so do not have to be accounted for here.
-	switch {
-	case ctr.HostConfig.NetworkMode.IsHost():
-		// In host-mode networking, the container does not have its own networking
-		// namespace, so both `/etc/hosts` and `/etc/resolv.conf` should be the same
-		// as on the host itself. The container gets a copy of these files.
-		*sboxOptions = append(
-			*sboxOptions,
-			libnetwork.OptionOriginHostsPath("/etc/hosts"),
-		)
-		originResolvConfPath = "/etc/resolv.conf"
-	case ctr.HostConfig.NetworkMode.IsUserDefined():
-		// The container uses a user-defined network. We use the embedded DNS
-		// server for container name resolution and to act as a DNS forwarder
-		// for external DNS resolution.
-		// We parse the DNS server(s) that are defined in /etc/resolv.conf on
-		// the host, which may be a local DNS server (for example, if DNSMasq or
-		// systemd-resolvd are in use). The embedded DNS server forwards DNS
-		// resolution to the DNS server configured on the host, which in itself
-		// may act as a forwarder for external DNS servers.
-		// If systemd-resolvd is used, the "upstream" DNS servers can be found in
-		// /run/systemd/resolve/resolv.conf. We do not query those DNS servers
-		// directly, as they can be dynamically reconfigured.
-		originResolvConfPath = "/etc/resolv.conf"
-	default:
-		// For other situations, such as the default bridge network, container
-		// discovery / name resolution is handled through /etc/hosts, and no
-		// embedded DNS server is available. Without the embedded DNS, we
-		// cannot use local DNS servers on the host (for example, if DNSMasq or
-		// systemd-resolvd is used). If systemd-resolvd is used, we try to
-		// determine the external DNS servers that are used on the host.
-		// This situation is not ideal, because DNS servers configured in the
-		// container are not updated after the container is created, but the
-		// DNS servers on the host can be dynamically updated.
-		//
-		// Copy the host's resolv.conf for the container (/run/systemd/resolve/resolv.conf or /etc/resolv.conf)
-		originResolvConfPath = cfg.GetResolvConf()
+	policy := resolverPolicyFor(ctr)
+
+	if policy.hostsOrigin != "" {
+		*sboxOptions = append(*sboxOptions, libnetwork.OptionOriginHostsPath(policy.hostsOrigin))
 	}
 
+	originResolvConfPath := policy.resolvConfOrigin(cfg)
+
 	// Allow tests to point at their own resolv.conf file.
 	if envPath := os.Getenv("DOCKER_TEST_RESOLV_CONF_PATH"); envPath != "" {
 		log.G(context.TODO()).Infof("Using OriginResolvConfPath from env: %s", envPath)
@@ -569,6 +818,70 @@ func buildSandboxPlatformOptions(ctr *container.Container, cfg *config.Config, s
 	}
 	*sboxOptions = append(*sboxOptions, libnetwork.OptionResolvConfPath(ctr.ResolvConfPath))
 
+	if policy.refresh == dnsRefreshWatch {
+		watchResolvConf(ctr, originResolvConfPath)
+	}
+
+	return nil
+}
+
+// watchResolvConf starts a background watch of originPath (the host-side
+// resolv.conf ctr's own resolv.conf was copied from) and re-copies it
+// into ctr.ResolvConfPath every time the kernel reports it was written,
+// so a long-running container picks up host DNS changes without a
+// restart. The watch exits once ctr.ResolvConfPath no longer exists,
+// which happens when the container is removed.
+func watchResolvConf(ctr *container.Container, originPath string) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		log.G(context.TODO()).WithError(err).Warn("unable to watch origin resolv.conf for changes")
+		return
+	}
+
+	// IN_CLOSE_WRITE rather than IN_MODIFY: resolv.conf rewriters
+	// typically reopen and rewrite the same file, and we want the
+	// write to be complete before we copy it. IN_MOVE_SELF/IN_DELETE_SELF
+	// cover the atomic rename(2)-into-place case, though we can't rearm
+	// a watch on the new inode afterwards.
+	if _, err := unix.InotifyAddWatch(fd, originPath, unix.IN_CLOSE_WRITE|unix.IN_MOVE_SELF|unix.IN_DELETE_SELF); err != nil {
+		unix.Close(fd)
+		log.G(context.TODO()).WithError(err).WithField("path", originPath).Warn("unable to watch origin resolv.conf for changes")
+		return
+	}
+
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, unix.SizeofInotifyEvent+unix.NAME_MAX+1)
+		for {
+			n, err := unix.Read(fd, buf)
+			if err != nil || n <= 0 {
+				return
+			}
+			if _, err := os.Stat(ctr.ResolvConfPath); err != nil {
+				// Container was removed; nothing left to refresh.
+				return
+			}
+			if err := copyResolvConf(originPath, ctr.ResolvConfPath); err != nil {
+				log.G(context.TODO()).WithError(err).WithField("container", ctr.ID).Warn("error refreshing resolv.conf from host")
+			}
+		}
+	}()
+}
+
+// copyResolvConf overwrites dst with src's contents, preserving dst's
+// existing file mode.
+func copyResolvConf(src, dst string) error {
+	info, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return errors.Wrap(err, "reading origin resolv.conf")
+	}
+	if err := os.WriteFile(dst, data, info.Mode()); err != nil {
+		return errors.Wrap(err, "writing container resolv.conf")
+	}
 	return nil
 }
 
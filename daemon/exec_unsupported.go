@@ -0,0 +1,32 @@
+package daemon
+
+// Deferred exec features
+//
+// The requests below ask for additions to the exec API and runtime
+// (ContainerExecCreate/ContainerExecInspect, the containerd exec process
+// spec, the daemon events API, and container-level cgroup management).
+// None of that machinery exists in this tree - there is no daemon/exec.go,
+// no exec API routes, and no cgroup or events wiring to extend - so
+// implementing any of them here would mean inventing the whole subsystem
+// rather than building on an existing one. They are recorded as deferred
+// rather than silently dropped; revisit once the exec runtime lands.
+//
+//   - cubxxw/moby#chunk4-1: per-exec --cap-add/--cap-drop. Needs
+//     ContainerExecCreate/ContainerExecInspect and the containerd exec
+//     process spec to plumb capabilities through and a container bounding
+//     set to validate them against.
+//
+//   - cubxxw/moby#chunk4-2: per-exec cgroup resource limits. Needs the
+//     same missing ExecConfig/exec-runtime plumbing as chunk4-1, plus a
+//     cgroup v1/v2 sub-cgroup manager; there is no container cgroup
+//     wiring here to nest a sub-cgroup under.
+//
+//   - cubxxw/moby#chunk4-3: detachable/resumable exec sessions. Needs a
+//     live exec-process registry (ExecIDs, TTY, ring buffer) and
+//     ContainerExecAttach semantics that this checkout never had to
+//     begin with; there is nothing to extend detach/reattach onto.
+//
+//   - cubxxw/moby#chunk4-4: structured exec audit log stream. Needs the
+//     daemon events API and an exec invocation call site to hook into;
+//     neither exists here, so there is nowhere to emit exec_audit events
+//     from.
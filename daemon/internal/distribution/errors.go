@@ -85,6 +85,16 @@ func (e unsupportedMediaTypeError) Error() string {
 	return "unsupported media type " + e.MediaType
 }
 
+// manifestConfigError returns nil for a model config media type and an
+// unsupportedMediaTypeError for any other. PullModel runs it first, so it
+// only proceeds for model artifacts; the image pull path does not call it.
+func manifestConfigError(mediaType string) error {
+	if isModelMediaType(mediaType) {
+		return nil
+	}
+	return unsupportedMediaTypeError{MediaType: mediaType}
+}
+
 // translatePullError is used to convert an error from a registry pull
 // operation to an error representing the entire pull operation. Any error
 // information which is not used by the returned error gets output to
@@ -109,6 +119,8 @@ func translatePullError(err error, ref reference.Named) error {
 		}
 	case xfer.DoNotRetry:
 		return translatePullError(v.Err, ref)
+	case modelBlobTooLargeError, unknownModelFrameworkError:
+		return errdefs.InvalidParameter(v)
 	}
 
 	return errdefs.Unknown(err)
@@ -139,6 +151,8 @@ func continueOnError(err error, mirrorEndpoint bool) bool {
 		return mirrorEndpoint
 	case unsupportedMediaTypeError:
 		return false
+	case modelBlobTooLargeError, unknownModelFrameworkError:
+		return false
 	case error:
 		return !strings.Contains(err.Error(), strings.ToLower(syscall.ESRCH.Error()))
 	default:
@@ -171,6 +185,10 @@ func retryOnError(err error) error {
 		return retryOnError(v.Err)
 	case *client.UnexpectedHTTPResponseError, unsupportedMediaTypeError:
 		return xfer.DoNotRetry{Err: err}
+	case modelBlobTooLargeError, unknownModelFrameworkError:
+		// Retrying won't change the blob's size or the manifest's declared
+		// framework, so don't bother re-fetching.
+		return xfer.DoNotRetry{Err: err}
 	case error:
 		if errors.Is(err, distribution.ErrBlobUnknown) {
 			return xfer.DoNotRetry{Err: err}
@@ -186,6 +204,10 @@ func retryOnError(err error) error {
 	return err
 }
 
+// AIModelNotSupportedError is kept for compatibility with older call sites
+// that still gate on it; the engine now has a pull path for AI model
+// artifacts (see model.go) so this is no longer returned from the normal
+// pull flow.
 type AIModelNotSupportedError struct{}
 
 func (e AIModelNotSupportedError) Error() string {
@@ -194,6 +216,32 @@ func (e AIModelNotSupportedError) Error() string {
 
 func (e AIModelNotSupportedError) InvalidParameter() {}
 
+// modelBlobTooLargeError is returned when a model artifact blob exceeds the
+// size the daemon is willing to buffer through the model store.
+type modelBlobTooLargeError struct {
+	digest  string
+	size    int64
+	maxSize int64
+}
+
+func (e modelBlobTooLargeError) Error() string {
+	return fmt.Sprintf("model blob %s is %d bytes, which exceeds the maximum allowed size of %d bytes", e.digest, e.size, e.maxSize)
+}
+
+func (e modelBlobTooLargeError) InvalidParameter() {}
+
+// unknownModelFrameworkError is returned when a model manifest's config
+// identifies a framework the daemon doesn't know how to store or serve.
+type unknownModelFrameworkError struct {
+	framework string
+}
+
+func (e unknownModelFrameworkError) Error() string {
+	return fmt.Sprintf("unknown AI model framework %q", e.framework)
+}
+
+func (e unknownModelFrameworkError) InvalidParameter() {}
+
 type invalidManifestClassError struct {
 	mediaType string
 	class     string
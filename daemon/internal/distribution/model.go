@@ -0,0 +1,244 @@
+package distribution
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// Model config media types recognized as OCI-compliant AI model artifacts
+// (ModelKit/CNAI-style). Manifests whose config descriptor uses one of these
+// media types are pulled and stored through the model store instead of the
+// image store, so graph drivers are never involved.
+const (
+	MediaTypeModelConfig    = "application/vnd.cncf.model.config.v1+json"
+	MediaTypeModelConfigAlt = "application/vnd.docker.ai.model.config.v1+json"
+)
+
+// maxModelBlobSize is the largest single model blob the daemon will buffer
+// through the model store. Model weights legitimately get large, but an
+// unbounded accept here would let a malicious registry exhaust disk.
+const maxModelBlobSize = 64 << 30 // 64GiB
+
+// isModelMediaType reports whether mediaType identifies an AI model config,
+// as opposed to an image config. manifestConfigError uses this so that
+// PullModel accepts model config media types and rejects every other one with
+// an unsupportedMediaTypeError; nothing in this package routes an image
+// manifest to PullModel.
+func isModelMediaType(mediaType string) bool {
+	switch mediaType {
+	case MediaTypeModelConfig, MediaTypeModelConfigAlt:
+		return true
+	default:
+		return false
+	}
+}
+
+// ModelMetadata is the subset of a model manifest's config that the daemon
+// persists alongside the blobs, used to answer inspect/list without
+// re-parsing the manifest.
+type ModelMetadata struct {
+	ID        digest.Digest     `json:"id"`
+	Reference string            `json:"reference"`
+	Framework string            `json:"framework"`
+	Size      int64             `json:"size"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// ModelStore is a content-addressed store for AI model artifacts. It is kept
+// entirely separate from the image/layer store so that model pulls never
+// touch a graphdriver.
+type ModelStore struct {
+	root string
+}
+
+// NewModelStore creates (if necessary) and returns a ModelStore rooted at
+// <root>/models.
+func NewModelStore(root string) (*ModelStore, error) {
+	blobs := filepath.Join(root, "models", "blobs")
+	if err := os.MkdirAll(blobs, 0o700); err != nil {
+		return nil, fmt.Errorf("creating model store: %w", err)
+	}
+	return &ModelStore{root: filepath.Join(root, "models")}, nil
+}
+
+func (s *ModelStore) blobPath(dgst digest.Digest) string {
+	return filepath.Join(s.root, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func (s *ModelStore) metadataPath(dgst digest.Digest) string {
+	return s.blobPath(dgst) + ".json"
+}
+
+// PutBlob verifies r against dgst, then writes it into the content-addressed
+// store. It rejects a blob whose declared size or copied length exceeds
+// maxModelBlobSize; it does not check the copied length against size.
+func (s *ModelStore) PutBlob(ctx context.Context, dgst digest.Digest, size int64, r io.Reader) error {
+	if size > 0 && size > maxModelBlobSize {
+		return modelBlobTooLargeError{digest: dgst.String(), size: size, maxSize: maxModelBlobSize}
+	}
+
+	dir := filepath.Dir(s.blobPath(dgst))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	verifier := dgst.Verifier()
+	n, err := io.Copy(tmp, io.TeeReader(r, verifier))
+	if err != nil {
+		return fmt.Errorf("writing model blob %s: %w", dgst, err)
+	}
+	if n > maxModelBlobSize {
+		return modelBlobTooLargeError{digest: dgst.String(), size: n, maxSize: maxModelBlobSize}
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("model blob %s failed content verification", dgst)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.blobPath(dgst))
+}
+
+// PutMetadata records the ModelMetadata for a model identified by its
+// manifest digest, used by Inspect and List.
+func (s *ModelStore) PutMetadata(dgst digest.Digest, md ModelMetadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.metadataPath(dgst)), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(s.metadataPath(dgst), data, 0o600)
+}
+
+// Inspect returns the metadata for a previously-pulled model.
+func (s *ModelStore) Inspect(dgst digest.Digest) (ModelMetadata, error) {
+	data, err := os.ReadFile(s.metadataPath(dgst))
+	if err != nil {
+		return ModelMetadata{}, err
+	}
+	var md ModelMetadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return ModelMetadata{}, err
+	}
+	return md, nil
+}
+
+// List returns the metadata for every model currently in the store.
+func (s *ModelStore) List() ([]ModelMetadata, error) {
+	var out []ModelMetadata
+	err := filepath.WalkDir(s.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var md ModelMetadata
+		if err := json.Unmarshal(data, &md); err != nil {
+			log.G(context.TODO()).WithError(err).WithField("path", path).Warn("skipping unreadable model metadata")
+			return nil
+		}
+		out = append(out, md)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ModelBlobDescriptor describes a single model blob to fetch, mirroring the
+// fields RegisterBatch/Register use for image layers.
+type ModelBlobDescriptor struct {
+	Digest    digest.Digest
+	Size      int64
+	MediaType string
+}
+
+// PullModel fetches and verifies every blob referenced by a model manifest,
+// storing the result in store. It does not touch the image store or any
+// graphdriver.
+//
+// Unlike an image layer pull, it doesn't go through
+// xfer.LayerDownloadManager: that type schedules downloads around a layer
+// chain's DiffIDs and hands callers back an image.RootFS, neither of which
+// apply to a model's flat, content-addressed blob set. fetch plays the
+// equivalent role for model blobs that xfer.DownloadDescriptor.Download
+// plays for layers.
+//
+// Each blob fetch is retried per policy (nil uses defaultRetryPolicy), the
+// same backoff-with-jitter-and-circuit-breaker behavior a registry image
+// pull gets against a flaky endpoint.
+func PullModel(ctx context.Context, store *ModelStore, ref reference.Named, manifestDigest digest.Digest, configMediaType, framework string, blobs []ModelBlobDescriptor, fetch func(context.Context, digest.Digest) (io.ReadCloser, error), policy *EndpointRetryPolicy) error {
+	if err := manifestConfigError(configMediaType); err != nil {
+		return err
+	}
+	if framework == "" {
+		return unknownModelFrameworkError{framework: framework}
+	}
+
+	endpoint := ref.Name()
+	var total int64
+	for _, b := range blobs {
+		rc, err := fetchBlobWithRetry(ctx, fetch, policy, endpoint, b.Digest)
+		if err != nil {
+			return err
+		}
+		err = store.PutBlob(ctx, b.Digest, b.Size, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		total += b.Size
+	}
+
+	return store.PutMetadata(manifestDigest, ModelMetadata{
+		ID:        manifestDigest,
+		Reference: ref.String(),
+		Framework: framework,
+		Size:      total,
+	})
+}
+
+// fetchBlobWithRetry calls fetch for dgst, retrying against policy's
+// backoff/circuit-breaker decision (see decideForEndpoint) until it either
+// succeeds or policy gives up on endpoint.
+func fetchBlobWithRetry(ctx context.Context, fetch func(context.Context, digest.Digest) (io.ReadCloser, error), policy *EndpointRetryPolicy, endpoint string, dgst digest.Digest) (io.ReadCloser, error) {
+	for attempt := 0; ; attempt++ {
+		rc, err := fetch(ctx, dgst)
+		if err == nil {
+			return rc, nil
+		}
+
+		decision := decideForEndpoint(policy, endpoint, attempt, err)
+		if decision.DoNotRetry {
+			return nil, retryOnError(err)
+		}
+		if decision.RetryAfter > 0 {
+			select {
+			case <-time.After(decision.RetryAfter):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package distribution
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/docker/distribution/registry/client"
+	"github.com/moby/moby/v2/daemon/internal/distribution/xfer"
+)
+
+// RetryDecision is the outcome of evaluating an error against an
+// EndpointRetryPolicy: either retry after a delay, give up on this endpoint
+// entirely, or fall back to the next endpoint without retrying this one.
+type RetryDecision struct {
+	// RetryAfter is how long the caller should wait before retrying the
+	// same endpoint. Zero means retry immediately.
+	RetryAfter time.Duration
+	// DoNotRetry means the operation as a whole should not be retried,
+	// mirroring xfer.DoNotRetry.
+	DoNotRetry bool
+	// Fallback means this endpoint should be abandoned in favor of the
+	// next one, without counting as a hard failure of the whole pull.
+	Fallback bool
+}
+
+// breakerState is the state of an EndpointRetryPolicy's circuit breaker for
+// a single endpoint.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type endpointState struct {
+	consecutiveFailures int
+	state               breakerState
+	openedAt            time.Time
+}
+
+// EndpointRetryPolicy implements exponential backoff with jitter and a
+// short-lived circuit breaker, tracked per registry endpoint, so a pull
+// against a flaky mirror neither hammers it nor gives up on the first
+// error.
+type EndpointRetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts per endpoint before
+	// RetryDecision.DoNotRetry is set. Zero means use a built-in default.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the computed backoff.
+	MaxBackoff time.Duration
+	// BreakerThreshold is the number of consecutive failures that opens
+	// the breaker for an endpoint.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before
+	// half-opening and allowing a single probe request through.
+	BreakerCooldown time.Duration
+
+	mu    sync.Mutex
+	state map[string]*endpointState
+}
+
+// defaultRetryPolicy is used by decideForEndpoint when it is passed a nil
+// *EndpointRetryPolicy. retryOnError and continueOnError do not consult it.
+var defaultRetryPolicy = NewEndpointRetryPolicy()
+
+// NewEndpointRetryPolicy returns a policy with sane defaults: 5 attempts,
+// 1s initial backoff doubling up to 30s, and a breaker that opens after 3
+// consecutive failures for 30s.
+func NewEndpointRetryPolicy() *EndpointRetryPolicy {
+	return &EndpointRetryPolicy{
+		MaxAttempts:      5,
+		InitialBackoff:   time.Second,
+		MaxBackoff:       30 * time.Second,
+		BreakerThreshold: 3,
+		BreakerCooldown:  30 * time.Second,
+		state:            map[string]*endpointState{},
+	}
+}
+
+func (p *EndpointRetryPolicy) stateFor(endpoint string) *endpointState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.state[endpoint]
+	if !ok {
+		s = &endpointState{}
+		p.state[endpoint] = s
+	}
+	return s
+}
+
+// Allowed reports whether endpoint's breaker currently permits a request.
+// A half-open breaker allows exactly one probe through.
+func (p *EndpointRetryPolicy) Allowed(endpoint string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.state[endpoint]
+	if !ok || s.state == breakerClosed {
+		return true
+	}
+	if s.state == breakerOpen && time.Since(s.openedAt) >= p.BreakerCooldown {
+		s.state = breakerHalfOpen
+		return true
+	}
+	return false
+}
+
+// RecordSuccess resets endpoint's failure streak and closes its breaker.
+func (p *EndpointRetryPolicy) RecordSuccess(endpoint string) {
+	s := p.stateFor(endpoint)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.consecutiveFailures = 0
+	s.state = breakerClosed
+}
+
+func (p *EndpointRetryPolicy) recordFailure(endpoint string) {
+	s := p.stateFor(endpoint)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.consecutiveFailures++
+	threshold := p.BreakerThreshold
+	if threshold <= 0 {
+		threshold = 3
+	}
+	if s.consecutiveFailures >= threshold {
+		s.state = breakerOpen
+		s.openedAt = time.Now()
+	}
+}
+
+// backoffFor computes the jittered exponential backoff for the given
+// attempt number (0-indexed).
+func (p *EndpointRetryPolicy) backoffFor(attempt int) time.Duration {
+	initial, maxBackoff := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = time.Second
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+	backoff := initial
+	for i := 0; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	// +/- 20% jitter so a flock of concurrent pulls against the same
+	// mirror don't retry in lockstep.
+	spread := int64(backoff) / 5
+	jitter := time.Duration(rand.Int63n(2*spread + 1))
+	return backoff - time.Duration(spread) + jitter
+}
+
+// isRetryableStatus reports whether a *client.UnexpectedHTTPResponseError's
+// status code represents a transient failure worth retrying.
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// decideForEndpoint evaluates err for endpoint against policy, updating the
+// endpoint's breaker state and returning a RetryDecision for the pull loop
+// to act on.
+func decideForEndpoint(policy *EndpointRetryPolicy, endpoint string, attempt int, err error) RetryDecision {
+	if policy == nil {
+		policy = defaultRetryPolicy
+	}
+
+	if !policy.Allowed(endpoint) {
+		log.G(context.TODO()).WithField("endpoint", endpoint).Debug("skipping endpoint: circuit breaker open")
+		return RetryDecision{DoNotRetry: true, Fallback: true}
+	}
+
+	wrapped := retryOnError(err)
+	if _, noRetry := wrapped.(xfer.DoNotRetry); !noRetry {
+		// retryOnError considers this transient; see whether it's also one
+		// of the status codes we count against the breaker.
+		if respErr, ok := err.(*client.UnexpectedHTTPResponseError); ok && !isRetryableStatus(respErr.StatusCode) {
+			policy.RecordSuccess(endpoint)
+			return RetryDecision{}
+		}
+
+		policy.recordFailure(endpoint)
+		maxAttempts := policy.MaxAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = 5
+		}
+		if attempt+1 >= maxAttempts {
+			return RetryDecision{DoNotRetry: true, Fallback: true}
+		}
+		return RetryDecision{RetryAfter: policy.backoffFor(attempt)}
+	}
+
+	policy.recordFailure(endpoint)
+	return RetryDecision{DoNotRetry: true, Fallback: true}
+}
@@ -0,0 +1,251 @@
+package layer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/log"
+	"github.com/docker/distribution"
+	"github.com/moby/moby/v2/daemon/internal/stringid"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+)
+
+// LayerSource is a single layer to register as part of a RegisterBatch call.
+// The layers are applied in the order given, each stacking on the previous
+// one (or, for the first entry, on RegisterBatch's parent argument).
+type LayerSource struct {
+	Reader     io.Reader
+	Descriptor distribution.Descriptor
+
+	// ProgressWriter, if set, receives a copy of Reader's bytes as they are
+	// read, so callers can report per-layer pull progress while the batch
+	// applies in the background.
+	ProgressWriter io.Writer
+}
+
+// pendingLayer is a layer that has been created in the graph driver and has
+// an open metadata transaction, but has not yet been assigned a chain ID or
+// committed. It exists so registerWithDescriptor and RegisterBatch can share
+// the same create/apply/commit-or-rollback state machine: a layer moves
+// through these states in order, and at any point before commit it can be
+// rolled back cleanly.
+type pendingLayer struct {
+	layer  *roLayer
+	tx     *fileMetadataTransaction
+	parent *roLayer
+}
+
+// beginPendingLayer creates cacheID in the graph driver, stacked on pid, and
+// opens the metadata transaction that will record it. The caller must
+// eventually call either commit or rollback on the result.
+func (ls *layerStore) beginPendingLayer(pid string, parent *roLayer, descriptor distribution.Descriptor) (*pendingLayer, error) {
+	layer := &roLayer{
+		parent:         parent,
+		cacheID:        stringid.GenerateRandomID(),
+		referenceCount: 1,
+		layerStore:     ls,
+		references:     map[Layer]struct{}{},
+		descriptor:     descriptor,
+	}
+
+	if err := ls.driver.Create(layer.cacheID, pid, nil); err != nil {
+		return nil, err
+	}
+
+	tx, err := ls.store.StartTransaction()
+	if err != nil {
+		if err := ls.driver.Remove(layer.cacheID); err != nil {
+			log.G(context.TODO()).WithFields(log.Fields{"cache-id": layer.cacheID, "error": err}).Error("Error cleaning up cache layer after error")
+		}
+		return nil, err
+	}
+
+	return &pendingLayer{layer: layer, tx: tx, parent: parent}, nil
+}
+
+// rollback discards a pendingLayer that will never be committed: it removes
+// the cacheID from the graph driver and cancels the metadata transaction.
+func (pl *pendingLayer) rollback(ls *layerStore) {
+	log.G(context.TODO()).WithField("cache-id", pl.layer.cacheID).Debug("Cleaning up cache layer after error")
+	if err := ls.driver.Remove(pl.layer.cacheID); err != nil {
+		log.G(context.TODO()).WithFields(log.Fields{"cache-id": pl.layer.cacheID, "error": err}).Error("Error cleaning up cache layer after error")
+	}
+	if err := pl.tx.Cancel(); err != nil {
+		log.G(context.TODO()).WithFields(log.Fields{"cache-id": pl.layer.cacheID, "error": err, "tx": pl.tx.String()}).Error("Error canceling metadata transaction")
+	}
+}
+
+// commit assigns pl's chain ID from its (by now applied) diffID and parent,
+// stores it, and registers it in the layer map. ls.layerL must be held by
+// the caller. If a layer with the same chain ID already exists, pl itself is
+// rolled back and the existing layer is returned instead, with a nil error:
+// this is the normal "this layer was already pulled" path, not a failure.
+func (pl *pendingLayer) commit(ls *layerStore) (Layer, error) {
+	layer := pl.layer
+
+	if layer.parent == nil {
+		layer.chainID = layer.diffID
+	} else {
+		layer.chainID = identity.ChainID([]digest.Digest{layer.parent.chainID, layer.diffID})
+	}
+
+	if err := storeLayer(pl.tx, layer); err != nil {
+		pl.rollback(ls)
+		return nil, err
+	}
+
+	if existingLayer := ls.get(layer.chainID); existingLayer != nil {
+		pl.rollback(ls)
+		return existingLayer.getReference(), nil
+	}
+
+	if err := pl.tx.Commit(layer.chainID); err != nil {
+		pl.rollback(ls)
+		return nil, err
+	}
+
+	ls.layerMap[layer.chainID] = layer
+
+	return layer.getReference(), nil
+}
+
+// RegisterBatch registers a chain of layers, applying each one concurrently
+// (bounded by ls.workerPoolSize) instead of one at a time, and committing
+// them to the metadata store in order once every apply has succeeded. If any
+// layer fails to apply, every layer in the batch is rolled back and no
+// partial chain is left registered.
+//
+// This is intended for image pulls, where the layers of an image are known
+// up front and applying them serially is the dominant cost of the pull.
+func (ls *layerStore) RegisterBatch(ctx context.Context, descs []LayerSource, parent ChainID) ([]Layer, error) {
+	if len(descs) == 0 {
+		return nil, nil
+	}
+
+	var p *roLayer
+	if string(parent) != "" {
+		ls.layerL.Lock()
+		p = ls.get(parent)
+		ls.layerL.Unlock()
+		if p == nil {
+			return nil, ErrLayerDoesNotExist
+		}
+		if p.depth()+len(descs) > maxLayerDepth {
+			ls.layerL.Lock()
+			ls.releaseLayer(p)
+			ls.layerL.Unlock()
+			return nil, ErrMaxDepthExceeded
+		}
+	}
+
+	// Pre-create every cacheID and graph driver snapshot up front, in
+	// dependency order, so each apply below can run against its own
+	// already-existing cacheID without waiting on the previous layer's
+	// apply to finish.
+	pending := make([]*pendingLayer, len(descs))
+	parentLayer := p
+	for i, desc := range descs {
+		var pid string
+		if parentLayer != nil {
+			pid = parentLayer.cacheID
+		}
+		pl, err := ls.beginPendingLayer(pid, parentLayer, desc.Descriptor)
+		if err != nil {
+			rollbackPending(ls, pending[:i])
+			if p != nil {
+				ls.layerL.Lock()
+				ls.releaseLayer(p)
+				ls.layerL.Unlock()
+			}
+			return nil, fmt.Errorf("failed to create layer %d of %d: %w", i+1, len(descs), err)
+		}
+		pending[i] = pl
+		parentLayer = pl.layer
+	}
+
+	if err := ls.applyPendingBatch(ctx, descs, pending); err != nil {
+		rollbackPending(ls, pending)
+		if p != nil {
+			ls.layerL.Lock()
+			ls.releaseLayer(p)
+			ls.layerL.Unlock()
+		}
+		return nil, err
+	}
+
+	ls.layerL.Lock()
+	defer ls.layerL.Unlock()
+
+	layers := make([]Layer, len(pending))
+	for i, pl := range pending {
+		l, err := pl.commit(ls)
+		if err != nil {
+			// Roll back every layer that hasn't committed yet; layers
+			// already committed (index < i) stay registered, same as a
+			// single Register call would leave earlier, already-applied
+			// layers in a multi-layer image alone.
+			rollbackPending(ls, pending[i+1:])
+			return nil, fmt.Errorf("failed to commit layer %d of %d: %w", i+1, len(descs), err)
+		}
+		layers[i] = l
+	}
+
+	return layers, nil
+}
+
+// applyPendingBatch runs applyTar for every pending layer concurrently,
+// bounded by ls.workerPoolSize, and returns the first error encountered (if
+// any), after every goroutine has finished.
+func (ls *layerStore) applyPendingBatch(ctx context.Context, descs []LayerSource, pending []*pendingLayer) error {
+	workers := ls.workerPoolSize
+	if workers <= 0 || workers > len(pending) {
+		workers = len(pending)
+	}
+
+	sem := make(chan struct{}, workers)
+	errs := make([]error, len(pending))
+
+	var wg sync.WaitGroup
+	for i := range pending {
+		i := i
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			r := descs[i].Reader
+			if descs[i].ProgressWriter != nil {
+				r = io.TeeReader(r, descs[i].ProgressWriter)
+			}
+
+			var pid string
+			if pending[i].parent != nil {
+				pid = pending[i].parent.cacheID
+			}
+			errs[i] = ls.applyTar(pending[i].tx, r, pid, pending[i].layer)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to apply layer %d of %d: %w", i+1, len(descs), err)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func rollbackPending(ls *layerStore, pending []*pendingLayer) {
+	for i := len(pending) - 1; i >= 0; i-- {
+		if pending[i] != nil {
+			pending[i].rollback(ls)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package layer
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -16,7 +16,6 @@ import (
 	"github.com/moby/moby/v2/daemon/internal/stringid"
 	"github.com/moby/sys/user"
 	"github.com/opencontainers/go-digest"
-	"github.com/opencontainers/image-spec/identity"
 	"github.com/vbatts/tar-split/tar/asm"
 	"github.com/vbatts/tar-split/tar/storage"
 )
@@ -40,6 +39,14 @@ type layerStore struct {
 
 	// protect *RWLayer() methods from operating on the same name/id
 	locker *locker.Locker
+
+	// chunkFetcher materializes lazy layers registered with RegisterLazy.
+	// It is nil unless the store was created with StoreOptions.ChunkFetcher
+	// set; while it is nil, RegisterLazy refuses to register lazy layers.
+	chunkFetcher ChunkFetcher
+
+	// workerPoolSize bounds how many layers RegisterBatch applies at once.
+	workerPoolSize int
 }
 
 // StoreOptions are the options used to create a new Store instance
@@ -48,6 +55,17 @@ type StoreOptions struct {
 	GraphDriver        string
 	GraphDriverOptions []string
 	IDMapping          user.IdentityMapping
+
+	// ChunkFetcher, if set, enables lazy layer registration via
+	// RegisterLazy: layers are registered from their table of contents
+	// alone and their real content is fetched through ChunkFetcher the
+	// first time something needs it.
+	ChunkFetcher ChunkFetcher
+
+	// WorkerPoolSize bounds how many layers of a single RegisterBatch call
+	// are applied concurrently. Zero means unbounded (one worker per
+	// layer in the batch).
+	WorkerPoolSize int
 }
 
 // NewStoreFromOptions creates a new Store instance
@@ -67,24 +85,26 @@ func NewStoreFromOptions(options StoreOptions) (Store, error) {
 
 	driverName := driver.String()
 	layerDBRoot := filepath.Join(options.Root, "image", driverName, "layerdb")
-	return newStoreFromGraphDriver(layerDBRoot, driver)
+	return newStoreFromGraphDriver(layerDBRoot, driver, options.ChunkFetcher, options.WorkerPoolSize)
 }
 
 // newStoreFromGraphDriver creates a new Store instance using the provided
 // metadata store and graph driver. The metadata store will be used to restore
 // the Store.
-func newStoreFromGraphDriver(root string, driver graphdriver.Driver) (Store, error) {
+func newStoreFromGraphDriver(root string, driver graphdriver.Driver, chunkFetcher ChunkFetcher, workerPoolSize int) (Store, error) {
 	ms, err := newFSMetadataStore(root)
 	if err != nil {
 		return nil, err
 	}
 
 	ls := &layerStore{
-		store:    ms,
-		driver:   driver,
-		layerMap: map[ChainID]*roLayer{},
-		mounts:   map[string]*mountedLayer{},
-		locker:   locker.New(),
+		store:          ms,
+		driver:         driver,
+		layerMap:       map[ChainID]*roLayer{},
+		mounts:         map[string]*mountedLayer{},
+		locker:         locker.New(),
+		chunkFetcher:   chunkFetcher,
+		workerPoolSize: workerPoolSize,
 	}
 
 	ids, mounts, err := ms.List()
@@ -147,6 +167,17 @@ func (ls *layerStore) loadLayer(layer ChainID) (*roLayer, error) {
 		return nil, fmt.Errorf("failed to get descriptor for %s: %s", layer, err)
 	}
 
+	rawTOC, err := ls.store.GetTOC(layer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get table of contents for %s: %s", layer, err)
+	}
+	var toc []tocEntry
+	if len(rawTOC) > 0 {
+		if err := json.Unmarshal(rawTOC, &toc); err != nil {
+			return nil, fmt.Errorf("failed to parse table of contents for %s: %s", layer, err)
+		}
+	}
+
 	cl = &roLayer{
 		chainID:    layer,
 		diffID:     diff,
@@ -155,6 +186,8 @@ func (ls *layerStore) loadLayer(layer ChainID) (*roLayer, error) {
 		layerStore: ls,
 		references: map[Layer]struct{}{},
 		descriptor: descriptor,
+		lazy:       len(toc) > 0,
+		toc:        toc,
 	}
 
 	if parent != "" {
@@ -254,11 +287,11 @@ func (ls *layerStore) Register(ts io.Reader, parent ChainID) (Layer, error) {
 	return ls.registerWithDescriptor(ts, parent, distribution.Descriptor{})
 }
 
+// registerWithDescriptor registers a single layer. It is a degenerate,
+// one-layer case of the same create/apply/commit-or-rollback state machine
+// RegisterBatch uses to register a whole chain of layers at once: see
+// pendingLayer in batch.go.
 func (ls *layerStore) registerWithDescriptor(ts io.Reader, parent ChainID, descriptor distribution.Descriptor) (Layer, error) {
-	// cErr is used to hold the error which will always trigger
-	// cleanup of creates sources but may not be an error returned
-	// to the caller (already exists).
-	var cErr error
 	var pid string
 	var p *roLayer
 
@@ -270,81 +303,45 @@ func (ls *layerStore) registerWithDescriptor(ts io.Reader, parent ChainID, descr
 			return nil, ErrLayerDoesNotExist
 		}
 		pid = p.cacheID
-		// Release parent chain if error
-		defer func() {
-			if cErr != nil {
-				ls.layerL.Lock()
-				ls.releaseLayer(p)
-				ls.layerL.Unlock()
-			}
-		}()
 		if p.depth() >= maxLayerDepth {
-			cErr = ErrMaxDepthExceeded
-			return nil, cErr
+			ls.layerL.Lock()
+			ls.releaseLayer(p)
+			ls.layerL.Unlock()
+			return nil, ErrMaxDepthExceeded
 		}
 	}
 
-	// Create new roLayer
-	layer := &roLayer{
-		parent:         p,
-		cacheID:        stringid.GenerateRandomID(),
-		referenceCount: 1,
-		layerStore:     ls,
-		references:     map[Layer]struct{}{},
-		descriptor:     descriptor,
-	}
-
-	if cErr = ls.driver.Create(layer.cacheID, pid, nil); cErr != nil {
-		return nil, cErr
-	}
-
-	tx, cErr := ls.store.StartTransaction()
-	if cErr != nil {
-		return nil, cErr
-	}
-
-	defer func() {
-		if cErr != nil {
-			log.G(context.TODO()).WithFields(log.Fields{"cache-id": layer.cacheID, "error": cErr}).Debug("Cleaning up cache layer after error")
-			if err := ls.driver.Remove(layer.cacheID); err != nil {
-				log.G(context.TODO()).WithFields(log.Fields{"cache-id": layer.cacheID, "error": err}).Error("Error cleaning up cache layer after error")
-			}
-			if err := tx.Cancel(); err != nil {
-				log.G(context.TODO()).WithFields(log.Fields{"cache-id": layer.cacheID, "error": err, "tx": tx.String()}).Error("Error canceling metadata transaction")
-			}
+	// Release parent chain if anything below fails.
+	releaseParent := func() {
+		if p != nil {
+			ls.layerL.Lock()
+			ls.releaseLayer(p)
+			ls.layerL.Unlock()
 		}
-	}()
-
-	if cErr = ls.applyTar(tx, ts, pid, layer); cErr != nil {
-		return nil, cErr
 	}
 
-	if layer.parent == nil {
-		layer.chainID = layer.diffID
-	} else {
-		layer.chainID = identity.ChainID([]digest.Digest{layer.parent.chainID, layer.diffID})
+	pl, err := ls.beginPendingLayer(pid, p, descriptor)
+	if err != nil {
+		releaseParent()
+		return nil, err
 	}
 
-	if cErr = storeLayer(tx, layer); cErr != nil {
-		return nil, cErr
+	if err := ls.applyTar(pl.tx, ts, pid, pl.layer); err != nil {
+		pl.rollback(ls)
+		releaseParent()
+		return nil, err
 	}
 
 	ls.layerL.Lock()
 	defer ls.layerL.Unlock()
 
-	if existingLayer := ls.get(layer.chainID); existingLayer != nil {
-		// Set error for cleanup, but do not return the error
-		cErr = errors.New("layer already exists")
-		return existingLayer.getReference(), nil
-	}
-
-	if cErr = tx.Commit(layer.chainID); cErr != nil {
-		return nil, cErr
+	layer, err := pl.commit(ls)
+	if err != nil {
+		releaseParent()
+		return nil, err
 	}
 
-	ls.layerMap[layer.chainID] = layer
-
-	return layer.getReference(), nil
+	return layer, nil
 }
 
 func (ls *layerStore) get(layer ChainID) *roLayer {
@@ -515,6 +512,15 @@ func (ls *layerStore) CreateRWLayer(name string, parent ChainID, opts *CreateRWL
 		references: map[RWLayer]*referencedRWLayer{},
 	}
 
+	// initFunc (used e.g. to seed /etc/hosts and friends) and bind mounts
+	// into the container both expect real files on disk, so the parent
+	// chain can't still be lazy by the time we hand the mount back.
+	if initFunc != nil || opts != nil && opts.MaterializeParent {
+		if err := ls.materializeChain(p); err != nil {
+			return nil, err
+		}
+	}
+
 	if initFunc != nil {
 		var err error
 		parentID, err = ls.initMount(m.mountID, parentID, mountLabel, initFunc, storageOpt)
@@ -675,6 +681,19 @@ func (ls *layerStore) initMount(graphID, parent, mountLabel string, initFunc Mou
 }
 
 func (ls *layerStore) getTarStream(rl *roLayer) (io.ReadCloser, error) {
+	ls.layerL.Lock()
+	lazy := rl.lazy
+	ls.layerL.Unlock()
+
+	if lazy {
+		if ls.chunkFetcher == nil {
+			return nil, fmt.Errorf("layer %s is lazy but store has no ChunkFetcher configured", rl.chainID)
+		}
+		if err := rl.Materialize(context.TODO(), ls.chunkFetcher); err != nil {
+			return nil, fmt.Errorf("failed to materialize lazy layer %s: %w", rl.chainID, err)
+		}
+	}
+
 	r, err := ls.store.TarSplitReader(rl.chainID)
 	if err != nil {
 		return nil, err
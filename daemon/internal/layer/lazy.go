@@ -0,0 +1,302 @@
+package layer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/docker/distribution"
+	"github.com/moby/moby/v2/daemon/internal/stringid"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+const (
+	// mediaTypeZstdChunked is the OCI layer media type used by zstd:chunked
+	// images, which carry a table of contents describing the layer's files
+	// as independently-addressable chunks instead of a single opaque blob.
+	mediaTypeZstdChunked = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// annotationStargzTOCDigest is the descriptor annotation eStargz and
+	// zstd:chunked images use to point at their table of contents.
+	annotationStargzTOCDigest = "containerd.io/snapshot/stargz/toc.digest"
+)
+
+// tocEntry describes a single file captured in a lazy layer's table of
+// contents. It carries enough information to reconstruct that file's tar
+// header without reading the file's content, and enough to fetch the
+// content later, on demand, via a ChunkFetcher.
+type tocEntry struct {
+	Name     string `json:"name"`
+	Type     byte   `json:"type"`
+	Size     int64  `json:"size"`
+	Mode     int64  `json:"mode"`
+	Digest   string `json:"digest"`
+	Offset   int64  `json:"offset"`
+	LinkName string `json:"linkName,omitempty"`
+}
+
+// ChunkFetcher fetches a range of a lazy layer's content by digest, so a
+// layer registered with RegisterLazy can be materialized after the fact
+// without having to download it in full up front.
+type ChunkFetcher interface {
+	FetchChunk(ctx context.Context, dgst digest.Digest, offset, size int64) (io.ReadCloser, error)
+}
+
+// IsLazyLayer reports whether a layer descriptor should be registered lazily,
+// via RegisterLazy, rather than fully materialized with Register: either it
+// declares the zstd:chunked media type, or it carries a stargz
+// table-of-contents annotation.
+func IsLazyLayer(descriptor distribution.Descriptor) bool {
+	if descriptor.MediaType == mediaTypeZstdChunked {
+		return true
+	}
+	_, ok := descriptor.Annotations[annotationStargzTOCDigest]
+	return ok
+}
+
+// RegisterLazy registers a layer from its table of contents without reading
+// or storing its full content. The content is fetched chunk-by-chunk later,
+// via Materialize, the first time something needs real file data from the
+// layer (for example a bind mount into a running container).
+//
+// ts must still be consumed in full: it is the original tar stream, used
+// here only to compute the layer's diffID and tar-split metadata so the
+// layer behaves identically to a fully materialized one from the outside.
+func (ls *layerStore) RegisterLazy(ts io.Reader, parent ChainID, toc []byte, mediaType string) (Layer, error) {
+	if ls.chunkFetcher == nil {
+		return nil, errors.New("lazy layer registration requires StoreOptions.ChunkFetcher")
+	}
+
+	var entries []tocEntry
+	if err := json.Unmarshal(toc, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse lazy layer table of contents: %w", err)
+	}
+
+	var cErr error
+	var pid string
+	var p *roLayer
+
+	if string(parent) != "" {
+		ls.layerL.Lock()
+		p = ls.get(parent)
+		ls.layerL.Unlock()
+		if p == nil {
+			return nil, ErrLayerDoesNotExist
+		}
+		pid = p.cacheID
+		defer func() {
+			if cErr != nil {
+				ls.layerL.Lock()
+				ls.releaseLayer(p)
+				ls.layerL.Unlock()
+			}
+		}()
+		if p.depth() >= maxLayerDepth {
+			cErr = ErrMaxDepthExceeded
+			return nil, cErr
+		}
+	}
+
+	layer := &roLayer{
+		parent:         p,
+		cacheID:        stringid.GenerateRandomID(),
+		referenceCount: 1,
+		layerStore:     ls,
+		references:     map[Layer]struct{}{},
+		descriptor:     distribution.Descriptor{MediaType: mediaType},
+		lazy:           true,
+		toc:            entries,
+	}
+
+	if cErr = ls.driver.Create(layer.cacheID, pid, nil); cErr != nil {
+		return nil, cErr
+	}
+
+	tx, cErr := ls.store.StartTransaction()
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	defer func() {
+		if cErr != nil {
+			log.G(context.TODO()).WithFields(log.Fields{"cache-id": layer.cacheID, "error": cErr}).Debug("Cleaning up lazy cache layer after error")
+			if err := ls.driver.Remove(layer.cacheID); err != nil {
+				log.G(context.TODO()).WithFields(log.Fields{"cache-id": layer.cacheID, "error": err}).Error("Error cleaning up lazy cache layer after error")
+			}
+			if err := tx.Cancel(); err != nil {
+				log.G(context.TODO()).WithFields(log.Fields{"cache-id": layer.cacheID, "error": err, "tx": tx.String()}).Error("Error canceling metadata transaction")
+			}
+		}
+	}()
+
+	if cErr = ls.applyLazyTar(tx, ts, entries, layer); cErr != nil {
+		return nil, cErr
+	}
+
+	if cErr = tx.SetTOC(toc); cErr != nil {
+		return nil, cErr
+	}
+
+	if layer.parent == nil {
+		layer.chainID = layer.diffID
+	} else {
+		layer.chainID = identity.ChainID([]digest.Digest{layer.parent.chainID, layer.diffID})
+	}
+
+	if cErr = storeLayer(tx, layer); cErr != nil {
+		return nil, cErr
+	}
+
+	ls.layerL.Lock()
+	defer ls.layerL.Unlock()
+
+	if existingLayer := ls.get(layer.chainID); existingLayer != nil {
+		cErr = errors.New("layer already exists")
+		return existingLayer.getReference(), nil
+	}
+
+	if cErr = tx.Commit(layer.chainID); cErr != nil {
+		return nil, cErr
+	}
+
+	ls.layerMap[layer.chainID] = layer
+
+	return layer.getReference(), nil
+}
+
+// applyLazyTar consumes ts in full to compute the layer's diffID and
+// tar-split metadata, without extracting any file content. It writes nothing
+// into the graph driver and creates no placeholder entries from the table of
+// contents: the layer's directory stays empty until Materialize writes the
+// regular files into it.
+func (ls *layerStore) applyLazyTar(tx *fileMetadataTransaction, ts io.Reader, entries []tocEntry, layer *roLayer) error {
+	tsw, err := tx.TarSplitWriter(true)
+	if err != nil {
+		return err
+	}
+	metaPacker := storage.NewJSONPacker(tsw)
+	defer tsw.Close()
+
+	digester := digest.Canonical.Digester()
+	tr := io.TeeReader(ts, digester.Hash())
+
+	rdr, err := asm.NewInputTarStream(tr, metaPacker, nil)
+	if err != nil {
+		return err
+	}
+
+	size, err := io.Copy(io.Discard, rdr)
+	if err != nil {
+		return err
+	}
+
+	layer.size = size
+	layer.diffID = digester.Digest()
+
+	log.G(context.TODO()).WithFields(log.Fields{"diffID": layer.diffID, "cache-id": layer.cacheID, "entries": len(entries)}).Debug("Registered lazy layer from table of contents")
+
+	return nil
+}
+
+// Materialize fetches every chunk listed in the layer's table of contents
+// through fetcher and writes it into the layer's real on-disk content,
+// clearing the lazy flag once every chunk has landed. It is safe to call
+// more than once; later calls after a successful materialize are a no-op.
+func (rl *roLayer) Materialize(ctx context.Context, fetcher ChunkFetcher) error {
+	ls := rl.layerStore
+
+	ls.layerL.Lock()
+	lazy := rl.lazy
+	entries := rl.toc
+	cacheID := rl.cacheID
+	ls.layerL.Unlock()
+
+	if !lazy {
+		return nil
+	}
+
+	driver, ok := ls.driver.(interface {
+		Get(id, mountLabel string) (string, error)
+		Put(id string) error
+	})
+	if !ok {
+		return fmt.Errorf("graph driver %s does not support materializing lazy layers", ls.driver.String())
+	}
+
+	dir, err := driver.Get(cacheID, "")
+	if err != nil {
+		return fmt.Errorf("failed to mount %s for materialization: %w", cacheID, err)
+	}
+	defer driver.Put(cacheID)
+
+	for _, entry := range entries {
+		if entry.Type != '0' && entry.Type != '\x00' {
+			// Only regular files carry fetchable content. Directories,
+			// symlinks and other non-regular entries are not created;
+			// the only directories made are a regular file's parents.
+			continue
+		}
+		if err := rl.materializeEntry(ctx, fetcher, dir, entry); err != nil {
+			return fmt.Errorf("failed to materialize %s in layer %s: %w", entry.Name, rl.chainID, err)
+		}
+	}
+
+	ls.layerL.Lock()
+	rl.lazy = false
+	ls.layerL.Unlock()
+
+	return nil
+}
+
+func (rl *roLayer) materializeEntry(ctx context.Context, fetcher ChunkFetcher, dir string, entry tocEntry) error {
+	dgst, err := digest.Parse(entry.Digest)
+	if err != nil {
+		return err
+	}
+
+	rc, err := fetcher.FetchChunk(ctx, dgst, entry.Offset, entry.Size)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	path := filepath.Join(dir, entry.Name)
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("lazy layer TOC entry %q escapes layer directory", entry.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(entry.Mode))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, rc)
+	return err
+}
+
+// materializeChain walks p and its ancestors, materializing each one that is
+// still lazy. It is used before handing out an RWLayer whose caller (an init
+// layer or a bind mount) expects real files on disk rather than placeholders.
+func (ls *layerStore) materializeChain(p *roLayer) error {
+	if ls.chunkFetcher == nil {
+		return nil
+	}
+	for l := p; l != nil; l = l.parent {
+		if err := l.Materialize(context.TODO(), ls.chunkFetcher); err != nil {
+			return fmt.Errorf("failed to materialize layer %s: %w", l.chainID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package bridge
+
+import (
+	"net"
+
+	"github.com/moby/moby/v2/daemon/libnetwork/types"
+	"github.com/vishvananda/netlink"
+)
+
+// gwMode describes how a bridge network's default gateway is exposed to its
+// containers.
+type gwMode string
+
+const (
+	// gwModeDefault gives containers a route to the outside world through
+	// the bridge's default gateway.
+	gwModeDefault gwMode = ""
+	// gwModeIsolated withholds the default route, so containers on the
+	// network can only reach other containers on the same bridge.
+	gwModeIsolated gwMode = "isolated"
+)
+
+// isolated reports whether m withholds the default route for its subnet.
+func (m gwMode) isolated() bool {
+	return m == gwModeIsolated
+}
+
+// networkConfiguration holds the user-facing configuration for a bridge
+// network, as parsed from its IPAM/driver options.
+type networkConfiguration struct {
+	BridgeName string
+
+	// AddressIPv4 is the legacy single-subnet configuration. AddressesIPv4
+	// is preferred; when it is empty, setupBridgeIPv4 uses AddressIPv4 alone.
+	AddressIPv4        *net.IPNet
+	AddressesIPv4      []*net.IPNet
+	DefaultGatewayIPv4 net.IP
+	InhibitIPv4        bool
+	GwModeIPv4         gwMode
+	Internal           bool
+
+	HairpinBackend HairpinBackend
+}
+
+// bridgeInterface wraps the bridge device's netlink state along with the
+// addressing this driver has assigned to it. bridgeIPv4 and gatewayIPv4 are
+// parallel slices: gatewayIPv4[n] is the gateway for the subnet at
+// bridgeIPv4[n] (see gatewayForIPv4).
+type bridgeInterface struct {
+	nlh  *netlink.Handle
+	Link netlink.Link
+
+	bridgeIPv4  []*net.IPNet
+	gatewayIPv4 []net.IP
+}
+
+// addresses returns the bridge's currently configured addresses in the given
+// netlink address family (netlink.FAMILY_V4 or FAMILY_V6).
+func (i *bridgeInterface) addresses(family int) ([]netlink.Addr, error) {
+	return i.nlh.AddrList(i.Link, family)
+}
+
+var errInvalidGateway = types.InvalidParameterErrorf("default gateway ip must be part of one of the bridge subnets")
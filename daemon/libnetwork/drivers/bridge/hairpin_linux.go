@@ -0,0 +1,149 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/log"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// HairpinBackend selects the mechanism used to enable hairpin/loopback
+// routing on a bridge.
+type HairpinBackend string
+
+const (
+	// HairpinBackendAuto picks the first backend that can satisfy the
+	// request: procfs, then the route-based fallback.
+	HairpinBackendAuto HairpinBackend = ""
+	// HairpinBackendProcfs writes directly to
+	// /proc/sys/net/ipv4/conf/<bridge>/route_localnet, as this package has
+	// always done. It requires write access to procfs, which rootless
+	// daemons don't have.
+	HairpinBackendProcfs HairpinBackend = "procfs"
+	// HairpinBackendRoute installs an equivalent local-routing rule via
+	// netlink instead of writing to procfs, for rootless or read-only-proc
+	// environments.
+	HairpinBackendRoute HairpinBackend = "route"
+)
+
+// errHairpinUnavailable is returned when none of the configured backends
+// can satisfy a hairpin routing request, so callers can degrade gracefully
+// (e.g. disable hairpin NAT for the network) instead of aborting creation.
+type errHairpinUnavailable struct {
+	backend HairpinBackend
+	cause   error
+}
+
+func (e errHairpinUnavailable) Error() string {
+	return fmt.Sprintf("hairpin routing backend %q unavailable: %v", e.backend, e.cause)
+}
+
+func (e errHairpinUnavailable) Unwrap() error { return e.cause }
+
+// hairpinConfigurator enables loopback/hairpin routing for traffic leaving
+// and re-entering a bridge through the same interface (needed for
+// container-to-container NAT loopback).
+type hairpinConfigurator interface {
+	// Enable turns on hairpin/loopback routing for the given bridge.
+	Enable(bridgeName string) error
+}
+
+// newHairpinConfigurator returns the configurator requested by backend, or
+// picks one automatically when backend is HairpinBackendAuto: procfs if
+// writable, otherwise the route-based fallback.
+func newHairpinConfigurator(backend HairpinBackend) (hairpinConfigurator, error) {
+	switch backend {
+	case HairpinBackendProcfs:
+		return procfsHairpinConfigurator{}, nil
+	case HairpinBackendRoute:
+		return routeHairpinConfigurator{}, nil
+	case HairpinBackendAuto:
+		if (procfsHairpinConfigurator{}).writable() {
+			return procfsHairpinConfigurator{}, nil
+		}
+		return routeHairpinConfigurator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown hairpin backend %q", backend)
+	}
+}
+
+// procfsHairpinConfigurator is the classic implementation: a direct write
+// to route_localnet under /proc/sys.
+type procfsHairpinConfigurator struct{}
+
+func (procfsHairpinConfigurator) sysPath(bridgeName string) string {
+	return filepath.Join("/proc/sys/net/ipv4/conf", bridgeName, "route_localnet")
+}
+
+// writable does a best-effort check that procfs is writable at all, used
+// to decide whether HairpinBackendAuto should pick this backend.
+func (c procfsHairpinConfigurator) writable() bool {
+	f, err := os.OpenFile("/proc/sys/net/ipv4/ip_forward", os.O_WRONLY, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func (c procfsHairpinConfigurator) Enable(bridgeName string) error {
+	sysPath := c.sysPath(bridgeName)
+	ipv4LoRoutingData, err := os.ReadFile(sysPath)
+	if err != nil {
+		return errHairpinUnavailable{backend: HairpinBackendProcfs, cause: fmt.Errorf("cannot read IPv4 local routing setup: %w", err)}
+	}
+	// Enable loopback addresses routing only if it isn't already enabled
+	if ipv4LoRoutingData[0] != '1' {
+		if err := os.WriteFile(sysPath, []byte{'1', '\n'}, 0o644); err != nil {
+			return errHairpinUnavailable{backend: HairpinBackendProcfs, cause: fmt.Errorf("unable to enable local routing for hairpin mode: %w", err)}
+		}
+	}
+	return nil
+}
+
+// routeHairpinConfigurator installs an equivalent local-routing rule via
+// netlink, for use when procfs is read-only (rootless daemons, some
+// non-Linux-derived sandboxes). A local route covering 127.0.0.0/8 scoped to
+// the bridge makes the kernel treat loopback-destined packets arriving on it
+// as locally deliverable instead of martian, the same effect route_localnet
+// has, without needing to write to /proc/sys.
+type routeHairpinConfigurator struct{}
+
+func (routeHairpinConfigurator) Enable(bridgeName string) error {
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return errHairpinUnavailable{backend: HairpinBackendRoute, cause: fmt.Errorf("looking up bridge link %s: %w", bridgeName, err)}
+	}
+
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+		Scope:     netlink.SCOPE_HOST,
+		Table:     unix.RT_TABLE_LOCAL,
+		Type:      unix.RTN_LOCAL,
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return errHairpinUnavailable{backend: HairpinBackendRoute, cause: fmt.Errorf("installing local route for %s: %w", bridgeName, err)}
+	}
+	return nil
+}
+
+// setupLoopbackAddressesRouting enables hairpin/loopback routing on the
+// bridge using the backend selected by config.HairpinBackend (or the
+// automatic choice, if unset).
+func setupLoopbackAddressesRouting(config *networkConfiguration, i *bridgeInterface) error {
+	configurator, err := newHairpinConfigurator(config.HairpinBackend)
+	if err != nil {
+		return err
+	}
+	if err := configurator.Enable(config.BridgeName); err != nil {
+		log.G(context.TODO()).WithError(err).WithField("bridge", config.BridgeName).Warn("hairpin routing backend could not be enabled")
+		return err
+	}
+	return nil
+}
@@ -5,8 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"os"
-	"path/filepath"
 
 	"github.com/containerd/log"
 	"github.com/moby/moby/v2/daemon/libnetwork/types"
@@ -28,9 +26,14 @@ func selectIPv4Address(addresses []netlink.Addr, selector *net.IPNet) (netlink.A
 }
 
 func setupBridgeIPv4(config *networkConfiguration, i *bridgeInterface) error {
+	subnets := config.AddressesIPv4
+	if len(subnets) == 0 && config.AddressIPv4 != nil {
+		subnets = []*net.IPNet{config.AddressIPv4}
+	}
+
 	// TODO(aker): the bridge driver panics if its bridgeIPv4 field isn't set. Once bridge subnet and bridge IP address
 	//             are decoupled, we should assign it only when it's really needed.
-	i.bridgeIPv4 = config.AddressIPv4
+	i.bridgeIPv4 = subnets
 
 	if !config.InhibitIPv4 && !config.GwModeIPv4.isolated() {
 		addrv4List, err := i.addresses(netlink.FAMILY_V4)
@@ -38,54 +41,84 @@ func setupBridgeIPv4(config *networkConfiguration, i *bridgeInterface) error {
 			return fmt.Errorf("failed to retrieve bridge interface addresses: %v", err)
 		}
 
-		addrv4, _ := selectIPv4Address(addrv4List, config.AddressIPv4)
+		wanted := make(map[string]*net.IPNet, len(subnets))
+		for _, subnet := range subnets {
+			addrv4, _ := selectIPv4Address(addrv4List, subnet)
+			wanted[subnet.String()] = subnet
 
-		if !types.CompareIPNet(addrv4.IPNet, config.AddressIPv4) {
-			if addrv4.IPNet != nil {
-				if err := i.nlh.AddrDel(i.Link, &addrv4); err != nil {
-					return fmt.Errorf("failed to remove current ip address from bridge: %v", err)
+			if !types.CompareIPNet(addrv4.IPNet, subnet) {
+				log.G(context.TODO()).Debugf("Assigning address to bridge interface %s: %s", config.BridgeName, subnet)
+				if err := i.nlh.AddrAdd(i.Link, &netlink.Addr{IPNet: subnet}); err != nil {
+					return fmt.Errorf("failed to add IPv4 address %s to bridge: %v", subnet, err)
 				}
 			}
-			log.G(context.TODO()).Debugf("Assigning address to bridge interface %s: %s", config.BridgeName, config.AddressIPv4)
-			if err := i.nlh.AddrAdd(i.Link, &netlink.Addr{IPNet: config.AddressIPv4}); err != nil {
-				return fmt.Errorf("failed to add IPv4 address %s to bridge: %v", config.AddressIPv4, err)
+		}
+
+		// Remove addresses that are no longer part of the configuration, so a
+		// bridge can be reconciled down from N subnets to a smaller set.
+		for _, addr := range addrv4List {
+			if addr.IPNet == nil {
+				continue
+			}
+			if _, ok := wanted[addr.IPNet.String()]; ok {
+				continue
+			}
+			if err := i.nlh.AddrDel(i.Link, &addr); err != nil { //nolint:gosec // addr is not retained beyond this call.
+				return fmt.Errorf("failed to remove stale ip address from bridge: %v", err)
 			}
 		}
 	}
 
 	if !config.Internal {
-		// Store the default gateway
-		i.gatewayIPv4 = config.AddressIPv4.IP
+		// Store the default gateways, one per configured subnet.
+		i.gatewayIPv4 = make([]net.IP, 0, len(subnets))
+		for _, subnet := range subnets {
+			i.gatewayIPv4 = append(i.gatewayIPv4, subnet.IP)
+		}
 	}
 
 	return nil
 }
 
+// gatewayForIPv4 returns the gateway address that should be used to reach
+// ip, i.e. the gateway whose subnet contains ip. It falls back to the first
+// configured gateway if none of the bridge's subnets contain ip.
+func (i *bridgeInterface) gatewayForIPv4(ip net.IP) net.IP {
+	for idx, gw := range i.gatewayIPv4 {
+		if idx < len(i.bridgeIPv4) && i.bridgeIPv4[idx] != nil && i.bridgeIPv4[idx].Contains(ip) {
+			return gw
+		}
+	}
+	if len(i.gatewayIPv4) > 0 {
+		return i.gatewayIPv4[0]
+	}
+	return nil
+}
+
 func setupGatewayIPv4(config *networkConfiguration, i *bridgeInterface) error {
-	if !i.bridgeIPv4.Contains(config.DefaultGatewayIPv4) {
+	idx := -1
+	for n, subnet := range i.bridgeIPv4 {
+		if subnet.Contains(config.DefaultGatewayIPv4) {
+			idx = n
+			break
+		}
+	}
+	if idx == -1 {
 		return errInvalidGateway
 	}
 	if config.Internal {
 		return types.InvalidParameterErrorf("no gateway can be set on an internal bridge network")
 	}
 
-	// Store requested default gateway
-	i.gatewayIPv4 = config.DefaultGatewayIPv4
-
-	return nil
-}
-
-func setupLoopbackAddressesRouting(config *networkConfiguration, i *bridgeInterface) error {
-	sysPath := filepath.Join("/proc/sys/net/ipv4/conf", config.BridgeName, "route_localnet")
-	ipv4LoRoutingData, err := os.ReadFile(sysPath)
-	if err != nil {
-		return fmt.Errorf("Cannot read IPv4 local routing setup: %v", err)
-	}
-	// Enable loopback addresses routing only if it isn't already enabled
-	if ipv4LoRoutingData[0] != '1' {
-		if err := os.WriteFile(sysPath, []byte{'1', '\n'}, 0o644); err != nil {
-			return fmt.Errorf("Unable to enable local routing for hairpin mode: %v", err)
-		}
+	// Store the requested gateway at the index of the subnet that actually
+	// contains it, matching gatewayForIPv4's index-correspondence invariant
+	// instead of always overwriting index 0.
+	if len(i.gatewayIPv4) <= idx {
+		grown := make([]net.IP, idx+1)
+		copy(grown, i.gatewayIPv4)
+		i.gatewayIPv4 = grown
 	}
+	i.gatewayIPv4[idx] = config.DefaultGatewayIPv4
+
 	return nil
 }
@@ -0,0 +1,79 @@
+//go:build linux
+
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// notExistMsgs are the stderr fragments iptables/ip6tables print for "-C"
+// (check) and "-D" (delete) when the rule, chain, target or match they refer
+// to simply isn't there — as opposed to the command having failed for some
+// other reason.
+var notExistMsgs = []string{
+	"Bad rule (does a matching rule exist in that chain?)",
+	"No chain/target/match by that name.",
+}
+
+// IPTError is returned by [IPTable.Raw] (and anything built on top of it)
+// when the underlying iptables/ip6tables invocation exits non-zero. It
+// carries the command and captured stderr so callers can distinguish
+// "rule/chain doesn't exist" from a real failure such as a missing kernel
+// module or a permission error, instead of every non-zero exit collapsing
+// into the same opaque string.
+type IPTError struct {
+	*exec.ExitError
+	Cmd    []string
+	Stderr []byte
+}
+
+func (e *IPTError) Error() string {
+	return fmt.Sprintf("iptables failed: %s: %s (%s)", strings.Join(e.Cmd, " "), e.Stderr, e.ExitError)
+}
+
+// ExitStatus returns the process exit code, or -1 if e wasn't caused by the
+// process actually running (e.g. the binary couldn't be exec'd at all).
+func (e *IPTError) ExitStatus() int {
+	if e.ExitError == nil {
+		return -1
+	}
+	return e.ExitError.ExitCode()
+}
+
+// IsNotExist reports whether e is iptables' way of saying the rule, chain,
+// target or match being checked/deleted doesn't exist.
+func (e *IPTError) IsNotExist() bool {
+	if e.ExitStatus() != 1 {
+		return false
+	}
+	stderr := string(e.Stderr)
+	for _, msg := range notExistMsgs {
+		if strings.Contains(stderr, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLocked reports whether e is iptables failing to acquire the xtables
+// lock, which is worth retrying rather than treating as a hard failure.
+func (e *IPTError) IsLocked() bool {
+	stderr := string(e.Stderr)
+	return strings.Contains(stderr, xLockWaitMsg) || strings.Contains(stderr, "Resource temporarily unavailable")
+}
+
+// IsUnsupportedProto reports whether e is iptables rejecting a `-p`/
+// `--protocol` value it doesn't recognize.
+func (e *IPTError) IsUnsupportedProto() bool {
+	stderr := string(e.Stderr)
+	return strings.Contains(stderr, "unknown protocol") || strings.Contains(stderr, "Unsupported protocol")
+}
+
+// asIPTError extracts an *IPTError from err, if there is one.
+func asIPTError(err error) (*IPTError, bool) {
+	var iptErr *IPTError
+	return iptErr, errors.As(err, &iptErr)
+}
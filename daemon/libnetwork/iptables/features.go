@@ -0,0 +1,105 @@
+//go:build linux
+
+package iptables
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Features describes what the detected iptables/ip6tables binary on this
+// host actually supports, so callers can gate behavior on it instead of
+// discovering the gap from an exec failing at the wrong time.
+type Features struct {
+	// WaitSupported is whether the binary understands --wait, used to
+	// queue on the xtables lock instead of failing outright. raw() omits
+	// --wait entirely when this is false.
+	WaitSupported bool
+	// XlockWaitSecondsSupported is whether --wait additionally accepts a
+	// number of seconds to wait, rather than just the bare flag.
+	XlockWaitSecondsSupported bool
+	// CheckSupported is whether the binary understands -C / --check.
+	// When false, exists() falls back to listing the chain with -S and
+	// matching the rule by hand.
+	CheckSupported bool
+	// RandomFully is whether the binary understands --random-fully,
+	// which MASQUERADE/SNAT rules should opt into for better source port
+	// randomization against port-reuse collisions.
+	RandomFully bool
+	// NFTablesBackend is whether the iptables binary itself is backed by
+	// the nf_tables kernel subsystem (i.e. iptables-nft) -- the same
+	// check driverFor uses to auto-select the nftables [Driver].
+	NFTablesBackend bool
+}
+
+var (
+	featuresOnce sync.Once
+	features     Features
+)
+
+// Features returns the detected feature set of the iptables binary on this
+// host. It probes the binary the first time it's called and caches the
+// result for the life of the process.
+func (iptable IPTable) Features() Features {
+	featuresOnce.Do(func() {
+		features = detectFeatures()
+	})
+	return features
+}
+
+// probeChain is the throwaway chain name used to probe -C/--random-fully
+// support without touching anything a real chain depends on.
+const probeChain = "docker-probe"
+
+// detectFeatures probes the iptables binary directly with exec.Command,
+// deliberately not going through IPTable.raw/Raw: those depend on Features
+// (to decide whether to add --wait), so probing through them would recurse.
+func detectFeatures() Features {
+	var f Features
+	if err := initCheck(); err != nil {
+		return f
+	}
+
+	if out, err := exec.Command(iptablesPath, "--version").CombinedOutput(); err == nil {
+		f.NFTablesBackend = strings.Contains(strings.ToLower(string(out)), "nf_tables")
+	}
+	if _, err := exec.Command(iptablesPath, "--wait", "-L", "-n").CombinedOutput(); err == nil {
+		f.WaitSupported = true
+		if _, err := exec.Command(iptablesPath, "--wait", "1", "-L", "-n").CombinedOutput(); err == nil {
+			f.XlockWaitSecondsSupported = true
+		}
+	}
+
+	if _, err := exec.Command(iptablesPath, "-t", string(Filter), "-N", probeChain).CombinedOutput(); err == nil {
+		defer exec.Command(iptablesPath, "-t", string(Filter), "-X", probeChain).Run() //nolint:errcheck
+		out, err := exec.Command(iptablesPath, "-t", string(Filter), "-C", probeChain, "-j", "RETURN").CombinedOutput()
+		// The probe chain is empty, so a working -C reports "no such
+		// rule" (exit 1); an unrecognized -C flag is rejected before
+		// iptables even looks at the chain, with a different message.
+		lower := strings.ToLower(string(out))
+		f.CheckSupported = err == nil || (exitErrorCode(err) == 1 && !strings.Contains(lower, "unknown option") && !strings.Contains(lower, "unrecognized option"))
+	}
+
+	if _, err := exec.Command(iptablesPath, "-t", string(Nat), "-N", probeChain).CombinedOutput(); err == nil {
+		defer exec.Command(iptablesPath, "-t", string(Nat), "-X", probeChain).Run() //nolint:errcheck
+		if _, err := exec.Command(iptablesPath, "-t", string(Nat), "-A", probeChain, "-j", "MASQUERADE", "--random-fully").CombinedOutput(); err == nil {
+			f.RandomFully = true
+		}
+		_ = exec.Command(iptablesPath, "-t", string(Nat), "-F", probeChain).Run()
+	}
+
+	return f
+}
+
+// exitErrorCode returns the process exit code for err, or -1 if err didn't
+// come from a process actually running (e.g. the binary couldn't be
+// exec'd at all).
+func exitErrorCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
@@ -65,14 +65,17 @@ const (
 )
 
 var (
-	iptablesPath  string
-	ip6tablesPath string
-	initOnce      sync.Once
+	iptablesPath         string
+	ip6tablesPath        string
+	iptablesRestorePath  string
+	ip6tablesRestorePath string
+	initOnce             sync.Once
 )
 
 // IPTable defines struct with [IPVersion].
 type IPTable struct {
 	ipVersion IPVersion
+	driver    Driver
 }
 
 // ChainInfo defines the iptables chain.
@@ -112,12 +115,18 @@ func detectIptables() {
 		return
 	}
 	iptablesPath = path
+	if path, err := exec.LookPath("iptables-restore"); err == nil {
+		iptablesRestorePath = path
+	}
 
 	path, err = exec.LookPath("ip6tables")
 	if err != nil {
 		log.G(context.TODO()).WithError(err).Warnf("unable to find ip6tables")
 	} else {
 		ip6tablesPath = path
+		if path, err := exec.LookPath("ip6tables-restore"); err == nil {
+			ip6tablesRestorePath = path
+		}
 	}
 }
 
@@ -159,7 +168,7 @@ func GetIptable(version IPVersion) *IPTable {
 	default:
 		panic("unknown IP version: " + version)
 	}
-	return &IPTable{ipVersion: version}
+	return &IPTable{ipVersion: version, driver: driverFor(version)}
 }
 
 // NewChain adds a new chain to ip table.
@@ -170,13 +179,8 @@ func (iptable IPTable) NewChain(name string, table Table) (*ChainInfo, error) {
 	if table == "" {
 		return nil, fmt.Errorf("could not create chain %s: invalid table name: table name is empty", name)
 	}
-	// Add chain if it doesn't exist
-	if _, err := iptable.Raw("-t", string(table), "-n", "-L", name); err != nil {
-		if output, err := iptable.Raw("-t", string(table), "-N", name); err != nil {
-			return nil, err
-		} else if len(output) != 0 {
-			return nil, fmt.Errorf("could not create %s/%s chain: %s", table, name, output)
-		}
+	if err := iptable.driver.NewChain(table, name); err != nil {
+		return nil, err
 	}
 	return &ChainInfo{
 		Name:      name,
@@ -231,7 +235,16 @@ func (iptable IPTable) ProgramRule(table Table, chain string, action Action, arg
 	if iptable.Exists(table, chain, args...) != (action == Delete) {
 		return nil
 	}
-	return iptable.RawCombinedOutput(append([]string{"-t", string(table), string(action), chain}, args...)...)
+	switch action {
+	case Append:
+		return iptable.driver.Append(table, chain, args)
+	case Insert:
+		return iptable.driver.Insert(table, chain, args)
+	case Delete:
+		return iptable.driver.Delete(table, chain, args)
+	default:
+		return fmt.Errorf("unsupported action %q", action)
+	}
 }
 
 // Prerouting adds linking rule to nat/PREROUTING chain.
@@ -274,27 +287,44 @@ func (c *ChainInfo) Remove() error {
 		_ = c.Output(Delete)
 	}
 	iptable := GetIptable(c.IPVersion)
-	_, _ = iptable.Raw("-t", string(c.Table), "-F", c.Name)
-	_, _ = iptable.Raw("-t", string(c.Table), "-X", c.Name)
+	_ = iptable.driver.RemoveChain(c.Table, c.Name)
 	return nil
 }
 
 // Exists checks if a rule exists
 func (iptable IPTable) Exists(table Table, chain string, rule ...string) bool {
-	return iptable.exists(false, table, chain, rule...)
+	if table == "" {
+		table = Filter
+	}
+	ok, err := iptable.driver.Exists(table, chain, rule)
+	if err != nil {
+		log.G(context.TODO()).WithError(err).Warnf("failed to check whether rule exists in %s/%s", table, chain)
+	}
+	return ok
 }
 
 // ExistsNative behaves as Exists with the difference it
 // will always invoke `iptables` binary.
 func (iptable IPTable) ExistsNative(table Table, chain string, rule ...string) bool {
-	return iptable.exists(true, table, chain, rule...)
+	ok, err := iptable.exists(true, table, chain, rule...)
+	if err != nil {
+		log.G(context.TODO()).WithError(err).Warnf("failed to check whether rule exists in %s/%s", table, chain)
+	}
+	return ok
 }
 
-func (iptable IPTable) exists(native bool, table Table, chain string, rule ...string) bool {
+// exists reports whether rule is present in table/chain. A "not found"
+// result from iptables (as opposed to a real failure) is reported as
+// (false, nil); a real failure is returned as a non-nil error, typically an
+// *[IPTError], so callers can tell the two apart instead of treating every
+// non-zero exit as "doesn't exist".
+func (iptable IPTable) exists(native bool, table Table, chain string, rule ...string) (bool, error) {
 	if err := initCheck(); err != nil {
-		// The exists() signature does not allow us to return an error, but at least
-		// we can skip the (likely invalid) exec invocation.
-		return false
+		return false, err
+	}
+
+	if table == "" {
+		table = Filter
 	}
 
 	f := iptable.Raw
@@ -302,13 +332,43 @@ func (iptable IPTable) exists(native bool, table Table, chain string, rule ...st
 		f = iptable.raw
 	}
 
-	if table == "" {
-		table = Filter
+	if !iptable.Features().CheckSupported {
+		return iptable.existsByListing(f, table, chain, rule...)
 	}
 
-	// if exit status is 0 then return true, the rule exists
-	_, err := f(append([]string{"-t", string(table), "-C", chain}, rule...)...)
-	return err == nil
+	_, err := withLockRetry(func() ([]byte, error) {
+		return f(append([]string{"-t", string(table), "-C", chain}, rule...)...)
+	})
+	if err == nil {
+		return true, nil
+	}
+	if iptErr, ok := asIPTError(err); ok && iptErr.IsNotExist() {
+		return false, nil
+	}
+	return false, err
+}
+
+// existsByListing is the fallback exists() uses on iptables binaries old
+// enough not to support -C: it lists table/chain's rules with -S and
+// compares each line against the rule being looked up verbatim, the way -C
+// itself would.
+func (iptable IPTable) existsByListing(f func(args ...string) ([]byte, error), table Table, chain string, rule ...string) (bool, error) {
+	out, err := withLockRetry(func() ([]byte, error) {
+		return f("-t", string(table), "-S", chain)
+	})
+	if err != nil {
+		if iptErr, ok := asIPTError(err); ok && iptErr.IsNotExist() {
+			return false, nil
+		}
+		return false, err
+	}
+	target := strings.Join(append([]string{"-A", chain}, rule...), " ")
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == target {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 const (
@@ -317,8 +377,32 @@ const (
 
 	// xLockWaitMsg is the iptables warning about xtables lock that can be suppressed.
 	xLockWaitMsg = "Another app is currently holding the xtables lock"
+
+	// lockRetryAttempts is how many times in all withLockRetry runs an
+	// operation that keeps failing because another process holds the
+	// xtables lock.
+	lockRetryAttempts = 3
+
+	// lockRetryDelay is how long withLockRetry waits between attempts.
+	lockRetryDelay = 200 * time.Millisecond
 )
 
+// withLockRetry runs f up to lockRetryAttempts times in all, running it again
+// while it fails because another process is holding the xtables lock.
+func withLockRetry(f func() ([]byte, error)) ([]byte, error) {
+	var out []byte
+	var err error
+	for attempt := 0; attempt < lockRetryAttempts; attempt++ {
+		out, err = f()
+		iptErr, ok := asIPTError(err)
+		if !ok || !iptErr.IsLocked() {
+			return out, err
+		}
+		time.Sleep(lockRetryDelay)
+	}
+	return out, err
+}
+
 func filterOutput(start time.Time, output []byte, args ...string) []byte {
 	if opTime := time.Since(start); opTime > opWarnTime {
 		// Flag operations that have taken a long time to complete
@@ -359,23 +443,36 @@ func (iptable IPTable) raw(args ...string) ([]byte, error) {
 		commandName = "ip6tables"
 	}
 
-	args = append([]string{"--wait"}, args...)
+	if iptable.Features().WaitSupported {
+		args = append([]string{"--wait"}, args...)
+	}
 	log.G(context.TODO()).Debugf("%s, %v", path, args)
 
 	startTime := time.Now()
 	output, err := exec.Command(path, args...).CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("iptables failed: %s %v: %s (%s)", commandName, strings.Join(args, " "), output, err)
+		iptErr := &IPTError{Cmd: append([]string{commandName}, args...), Stderr: output}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			iptErr.ExitError = exitErr
+		}
+		return nil, iptErr
 	}
 
 	return filterOutput(startTime, output, args...), err
 }
 
 // RawCombinedOutput internally calls the Raw function and returns a non nil
-// error if Raw returned a non nil error or a non empty output
+// error if Raw returned a non nil error or a non empty output. The error
+// returned by Raw, typically an *[IPTError], is propagated unwrapped so
+// callers can use errors.As against it.
 func (iptable IPTable) RawCombinedOutput(args ...string) error {
-	if output, err := iptable.Raw(args...); err != nil || len(output) != 0 {
-		return fmt.Errorf("%s (%v)", string(output), err)
+	output, err := iptable.Raw(args...)
+	if err != nil {
+		return err
+	}
+	if len(output) != 0 {
+		return fmt.Errorf("%s", string(output))
 	}
 	return nil
 }
@@ -383,24 +480,44 @@ func (iptable IPTable) RawCombinedOutput(args ...string) error {
 // RawCombinedOutputNative behave as RawCombinedOutput with the difference it
 // will always invoke `iptables` binary
 func (iptable IPTable) RawCombinedOutputNative(args ...string) error {
-	if output, err := iptable.raw(args...); err != nil || len(output) != 0 {
-		return fmt.Errorf("%s (%v)", string(output), err)
+	output, err := iptable.raw(args...)
+	if err != nil {
+		return err
+	}
+	if len(output) != 0 {
+		return fmt.Errorf("%s", string(output))
 	}
 	return nil
 }
 
 // ExistChain checks if a chain exists
 func (iptable IPTable) ExistChain(chain string, table Table) bool {
-	_, err := iptable.Raw("-t", string(table), "-nL", chain)
-	return err == nil
+	_, err := withLockRetry(func() ([]byte, error) {
+		return iptable.Raw("-t", string(table), "-nL", chain)
+	})
+	if err == nil {
+		return true
+	}
+	if iptErr, ok := asIPTError(err); ok && iptErr.IsNotExist() {
+		return false
+	}
+	log.G(context.TODO()).WithError(err).Warnf("failed to check whether chain %s/%s exists", table, chain)
+	return false
 }
 
-// FlushChain flush chain if it exists
+// FlushChain flushes chain, if it exists. A real failure (as opposed to the
+// chain simply not existing) is returned rather than swallowed.
 func (iptable IPTable) FlushChain(table Table, chain string) error {
-	if !iptable.ExistChain(chain, table) {
+	_, err := withLockRetry(func() ([]byte, error) {
+		return iptable.Raw("-t", string(table), "-F", chain)
+	})
+	if err == nil {
 		return nil
 	}
-	return iptable.RawCombinedOutput("-t", string(table), "-F", chain)
+	if iptErr, ok := asIPTError(err); ok && iptErr.IsNotExist() {
+		return nil
+	}
+	return err
 }
 
 // SetDefaultPolicy sets the passed default policy for the table/chain
@@ -463,7 +580,17 @@ func (r Rule) cmdArgs(op Action) []string {
 }
 
 func (r Rule) exec(op Action) error {
-	return GetIptable(r.IPVer).RawCombinedOutput(r.cmdArgs(op)...)
+	iptable := GetIptable(r.IPVer)
+	switch op {
+	case Append:
+		return iptable.driver.Append(r.Table, r.Chain, r.Args)
+	case Insert:
+		return iptable.driver.Insert(r.Table, r.Chain, r.Args)
+	case Delete:
+		return iptable.driver.Delete(r.Table, r.Chain, r.Args)
+	default:
+		return fmt.Errorf("unsupported action %q", op)
+	}
 }
 
 // WithChain returns a version of the rule with its Chain field set to chain.
@@ -497,10 +624,16 @@ func (r Rule) Insert() error {
 
 // Delete deletes the rule from the kernel. If the rule does not exist, this is a no-op.
 func (r Rule) Delete() error {
-	if !r.Exists() {
+	_, err := withLockRetry(func() ([]byte, error) {
+		return nil, r.exec(Delete)
+	})
+	if err == nil {
+		return nil
+	}
+	if iptErr, ok := asIPTError(err); ok && iptErr.IsNotExist() {
 		return nil
 	}
-	return r.exec(Delete)
+	return err
 }
 
 func (r Rule) String() string {
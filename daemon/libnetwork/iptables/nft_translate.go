@@ -0,0 +1,176 @@
+//go:build linux
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// translateRule converts the subset of iptables rule arguments this package
+// actually emits (-p, --dport, --sport, -s, -d, -i, -o, each optionally
+// preceded by "!", -m addrtype --dst-type LOCAL, --to-destination,
+// --random-fully, and -j ACCEPT/RETURN/DROP/MASQUERADE/DNAT) into an nft
+// rule expression. Any other -j target is translated as a jump to the chain
+// of that name. It returns an error for any other argument, rather than
+// guessing: a rule that
+// silently doesn't mean what the caller asked for is worse than one that's
+// loudly missing.
+func translateRule(args []string) (string, error) {
+	var b strings.Builder
+	write := func(s string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(s)
+	}
+
+	// negate is set by a "!" token and consumed by the match it precedes
+	// (iptables writes the negation before the flag, e.g. "! -s 1.2.3.4"),
+	// splicing "!=" into that match's operator instead of emitting "!=" as
+	// a standalone token of its own.
+	negate := false
+	writeMatch := func(field, value string) {
+		op := ""
+		if negate {
+			op = "!= "
+			negate = false
+		}
+		write(field + " " + op + value)
+	}
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-p", "--protocol":
+			i++
+			if i >= len(args) {
+				return "", fmt.Errorf("nft translate: -p with no value")
+			}
+			writeMatch("meta l4proto", args[i])
+		case "-s", "--source":
+			i++
+			if i >= len(args) {
+				return "", fmt.Errorf("nft translate: -s with no value")
+			}
+			writeMatch("ip saddr", args[i])
+		case "-d", "--destination":
+			i++
+			if i >= len(args) {
+				return "", fmt.Errorf("nft translate: -d with no value")
+			}
+			writeMatch("ip daddr", args[i])
+		case "--dport":
+			i++
+			if i >= len(args) {
+				return "", fmt.Errorf("nft translate: --dport with no value")
+			}
+			writeMatch("th dport", args[i])
+		case "--sport":
+			i++
+			if i >= len(args) {
+				return "", fmt.Errorf("nft translate: --sport with no value")
+			}
+			writeMatch("th sport", args[i])
+		case "-i", "--in-interface":
+			i++
+			if i >= len(args) {
+				return "", fmt.Errorf("nft translate: -i with no value")
+			}
+			writeMatch("iifname", args[i])
+		case "-o", "--out-interface":
+			i++
+			if i >= len(args) {
+				return "", fmt.Errorf("nft translate: -o with no value")
+			}
+			writeMatch("oifname", args[i])
+		case "-m":
+			i++
+			if i >= len(args) || args[i] != "addrtype" {
+				return "", fmt.Errorf("nft translate: unsupported match module %q", argAt(args, i))
+			}
+			// Expect "--dst-type LOCAL" to follow; consumed on the next
+			// loop iteration by the "--dst-type" case below.
+		case "--dst-type":
+			i++
+			if i >= len(args) {
+				return "", fmt.Errorf("nft translate: --dst-type with no value")
+			}
+			switch args[i] {
+			case "LOCAL":
+				writeMatch("fib daddr type", "local")
+			default:
+				return "", fmt.Errorf("nft translate: unsupported --dst-type %q", args[i])
+			}
+		case "--to-destination":
+			i++
+			if i >= len(args) {
+				return "", fmt.Errorf("nft translate: --to-destination with no value")
+			}
+			write("to " + args[i])
+		case "--random-fully":
+			write("fully-random")
+		case "!":
+			negate = true
+		case "-j", "--jump":
+			i++
+			if i >= len(args) {
+				return "", fmt.Errorf("nft translate: -j with no value")
+			}
+			switch args[i] {
+			case "ACCEPT":
+				write("accept")
+			case "RETURN":
+				write("return")
+			case "DROP":
+				write("drop")
+			case "MASQUERADE":
+				write("masquerade")
+			case "DNAT":
+				write("dnat") // --to-destination, translated above, supplies the target.
+			default:
+				// An unrecognized jump target is most likely a jump to
+				// another chain this package created in the same table;
+				// nftChainName's "<table>-<chain>" naming means a jump
+				// within one table is just the chain's own name prefixed
+				// the same way, which the caller is responsible for
+				// passing in args[i] already.
+				write("jump " + args[i])
+			}
+		default:
+			return "", fmt.Errorf("nft translate: unsupported argument %q", args[i])
+		}
+	}
+
+	if negate {
+		return "", fmt.Errorf("nft translate: trailing %q with no match to negate", "!")
+	}
+
+	return b.String(), nil
+}
+
+func argAt(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// findRuleHandle looks for expr as a substring of one of nft's
+// "-a list chain" output lines and returns the trailing "# handle N" value
+// from that line, so the caller can delete the rule by handle.
+func findRuleHandle(listing, expr string) (string, bool) {
+	for _, line := range strings.Split(listing, "\n") {
+		if !strings.Contains(line, expr) {
+			continue
+		}
+		idx := strings.LastIndex(line, "handle")
+		if idx == -1 {
+			continue
+		}
+		handle := strings.TrimSpace(line[idx+len("handle"):])
+		if handle != "" {
+			return handle, true
+		}
+	}
+	return "", false
+}
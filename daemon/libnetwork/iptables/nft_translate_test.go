@@ -0,0 +1,61 @@
+//go:build linux
+
+package iptables
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestTranslateRule(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "source match",
+			args: []string{"-s", "10.0.0.1", "-j", "ACCEPT"},
+			want: "ip saddr 10.0.0.1 accept",
+		},
+		{
+			name: "negated source match",
+			args: []string{"!", "-s", "10.0.0.1", "-j", "DROP"},
+			want: "ip saddr != 10.0.0.1 drop",
+		},
+		{
+			name: "negated destination port",
+			args: []string{"-p", "tcp", "!", "--dport", "22", "-j", "ACCEPT"},
+			want: "meta l4proto tcp th dport != 22 accept",
+		},
+		{
+			name: "dst-type with negated destination",
+			args: []string{"-m", "addrtype", "--dst-type", "LOCAL", "!", "-d", "127.0.0.1", "-j", "DROP"},
+			want: "fib daddr type local ip daddr != 127.0.0.1 drop",
+		},
+		{
+			name: "dnat with to-destination",
+			args: []string{"-p", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", "10.0.0.2:8080"},
+			want: "meta l4proto tcp th dport 80 dnat to 10.0.0.2:8080",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := translateRule(tc.args)
+			assert.NilError(t, err)
+			assert.Equal(t, got, tc.want)
+		})
+	}
+}
+
+func TestTranslateRuleTrailingNegation(t *testing.T) {
+	_, err := translateRule([]string{"-s", "10.0.0.1", "!"})
+	assert.ErrorContains(t, err, "trailing")
+}
+
+func TestTranslateRuleUnsupportedArgument(t *testing.T) {
+	_, err := translateRule([]string{"--unsupported-flag"})
+	assert.ErrorContains(t, err, "unsupported argument")
+}
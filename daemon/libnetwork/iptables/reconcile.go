@@ -0,0 +1,172 @@
+//go:build linux
+
+package iptables
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/containerd/log"
+)
+
+const (
+	// defaultReconcileInterval is how often a [Reconciler] re-checks that
+	// every registered rule is still present, if NewReconciler isn't given
+	// one explicitly.
+	defaultReconcileInterval = 30 * time.Second
+
+	// reconcileJitter is the maximum extra random delay added on top of
+	// the interval, so that many nodes restarting together don't all poll
+	// in lockstep.
+	reconcileJitter = 10 * time.Second
+)
+
+// ownedRule is a [Rule] this package installed on behalf of some owner,
+// remembered so a [Reconciler] can re-apply it if it goes missing.
+type ownedRule struct {
+	rule Rule
+	op   Action // Append or Insert: how the rule was originally added
+}
+
+// Reconciler periodically verifies that every [Rule] registered with it is
+// still present in the kernel, and re-applies any that have gone missing --
+// because firewalld reloaded, something ran `iptables -F`, or the daemon
+// itself was restarted with --iptables toggled off and back on. Rules are
+// grouped by an owner id (typically a network or endpoint id), so a caller
+// can drop all of its rules at once with Deregister.
+//
+// Checking is done one [Rule.Exists] call per registered rule; a future
+// version could instead diff against a single `iptables-save` dump to make
+// a poll cost one exec regardless of how many rules are registered, the way
+// [Transaction] does for writes.
+//
+// The zero value is not usable; construct one with NewReconciler.
+type Reconciler struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	rules map[string][]ownedRule
+
+	resyncCh chan struct{}
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// NewReconciler creates a Reconciler that polls every interval, plus
+// jitter. A zero or negative interval uses defaultReconcileInterval. The
+// returned Reconciler does nothing until Start is called.
+func NewReconciler(interval time.Duration) *Reconciler {
+	if interval <= 0 {
+		interval = defaultReconcileInterval
+	}
+	return &Reconciler{
+		interval: interval,
+		rules:    make(map[string][]ownedRule),
+		resyncCh: make(chan struct{}, 1),
+	}
+}
+
+// Register records rules as owned by owner, so the Reconciler re-applies
+// any of them that's later found missing. op is the Action (Append or
+// Insert) each rule was originally programmed with, so a re-apply lands
+// back in the same place.
+func (r *Reconciler) Register(owner string, op Action, rules ...Rule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rule := range rules {
+		r.rules[owner] = append(r.rules[owner], ownedRule{rule: rule, op: op})
+	}
+}
+
+// Deregister forgets every rule registered under owner. It does not remove
+// the rules from the kernel; callers that want that should delete them
+// before deregistering.
+func (r *Reconciler) Deregister(owner string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.rules, owner)
+}
+
+// Start launches the Reconciler's background poll loop. Calling Start again
+// before Stop is a no-op.
+func (r *Reconciler) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go r.loop(ctx)
+}
+
+// Stop ends the background poll loop and waits for it to exit. It's safe to
+// call Stop without a prior Start, or more than once.
+func (r *Reconciler) Stop() {
+	r.mu.Lock()
+	cancel := r.cancel
+	done := r.done
+	r.cancel = nil
+	r.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// NotifyReload requests an immediate re-sync instead of waiting for the
+// next poll tick. It's meant to be wired to firewalld's D-Bus "Reloaded"
+// signal (see firewalldInit/passthrough), so rules come back the moment
+// firewalld wipes and reloads its tables rather than up to one poll
+// interval later.
+func (r *Reconciler) NotifyReload() {
+	select {
+	case r.resyncCh <- struct{}{}:
+	default: // a re-sync is already pending
+	}
+}
+
+func (r *Reconciler) loop(ctx context.Context) {
+	defer close(r.done)
+	for {
+		r.reconcileOnce()
+
+		wait := r.interval + time.Duration(rand.Int63n(int64(reconcileJitter)))
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-r.resyncCh:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
+// reconcileOnce checks every registered rule and re-applies any that are
+// missing from the kernel.
+func (r *Reconciler) reconcileOnce() {
+	r.mu.Lock()
+	snapshot := make(map[string][]ownedRule, len(r.rules))
+	for owner, owned := range r.rules {
+		snapshot[owner] = append([]ownedRule(nil), owned...)
+	}
+	r.mu.Unlock()
+
+	for owner, owned := range snapshot {
+		for _, o := range owned {
+			if o.rule.Exists() {
+				continue
+			}
+			log.G(context.TODO()).Warnf("iptables: rule for %s missing after external flush, re-applying: %s", owner, o.rule)
+			if err := o.rule.exec(o.op); err != nil {
+				log.G(context.TODO()).WithError(err).Warnf("iptables: failed to re-apply rule for %s", owner)
+			}
+		}
+	}
+}
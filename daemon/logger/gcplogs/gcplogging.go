@@ -2,8 +2,12 @@ package gcplogs
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +17,7 @@ import (
 	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/logging"
 	"github.com/containerd/log"
+	metrics "github.com/docker/go-metrics"
 	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
 )
 
@@ -28,8 +33,78 @@ const (
 	logZoneKey        = "gcp-meta-zone"
 	logNameKey        = "gcp-meta-name"
 	logIDKey          = "gcp-meta-id"
+
+	resourceTypeOptKey    = "gcp-resource-type"
+	clusterNameOptKey     = "gcp-cluster-name"
+	clusterLocationOptKey = "gcp-cluster-location"
+
+	// resourceTypeAuto picks k8s_container when the container looks like
+	// it's running under GKE, falling back to gce_instance when instance
+	// metadata is available (on GCE, or from the gcp-meta-* options) and to
+	// no resource at all otherwise. It's the default.
+	resourceTypeAuto         = ""
+	resourceTypeGCEInstance  = "gce_instance"
+	resourceTypeK8SContainer = "k8s_container"
+
+	// Labels dockershim/cri-dockerd set on containers it creates on behalf
+	// of a kubelet, used to recognize a GKE pod and fill in its
+	// k8s_container MonitoredResource.
+	k8sNamespaceLabel = "io.kubernetes.pod.namespace"
+	k8sPodNameLabel   = "io.kubernetes.pod.name"
+	k8sContainerLabel = "io.kubernetes.container.name"
+
+	// logFormatOptKey selects how Log parses m.Line before sending it on.
+	logFormatOptKey = "gcp-log-format"
+
+	// logFormatRaw is the default: the line is sent verbatim as
+	// dockerLogEntry.Message at logging.Default severity (or Warning, for
+	// stderr).
+	logFormatRaw = "raw"
+	// logFormatJSON treats each line as a JSON object, promoting recognized
+	// fields into Entry and the rest into Entry.Payload.
+	logFormatJSON = "json"
+	// logFormatGlog parses the leading glog severity letter (I/W/E/F) off
+	// each line into the matching Entry.Severity.
+	logFormatGlog = "glog"
+
+	// bufferSizeOptKey is a friendlier alias for entryCountThresholdOptKey;
+	// if both are set, entryCountThresholdOptKey wins.
+	bufferSizeOptKey          = "gcp-buffer-size"
+	bufferMaxBytesOptKey      = "gcp-buffer-max-bytes"
+	flushIntervalOptKey       = "gcp-flush-interval"
+	entryCountThresholdOptKey = "gcp-entry-count-threshold"
+	entryByteThresholdOptKey  = "gcp-entry-byte-threshold"
+	concurrentWritesOptKey    = "gcp-concurrent-writes"
+
+	// modeOptKey selects whether Log blocks until the client accepts the
+	// entry (modeBlocking) or returns immediately and relies on the
+	// background buffer, dropping on overflow (modeNonBlocking, default).
+	modeOptKey      = "gcp-mode"
+	modeBlocking    = "blocking"
+	modeNonBlocking = "non-blocking"
+
+	// Conventional label/env keys Cloud Logging's container agents
+	// recognize. Rather than burying these in Payload like the rest of a
+	// container's extra attributes, New lifts them onto the matching
+	// logging.Entry field so they behave the same way here as they would
+	// for a process logging directly through the Cloud Logging agent.
+	gcpLabelsKey = "logging.googleapis.com/labels"
+	gcpTraceKey  = "logging.googleapis.com/trace"
+	gcpSpanIDKey = "logging.googleapis.com/spanId"
 )
 
+var (
+	metricsNamespace = metrics.NewNamespace("gcplogs", "", nil)
+	// droppedLogsCounter is metricsNamespace's per-container view of
+	// droppedLogs below, for operators scraping Docker's metrics endpoint
+	// rather than grepping the daemon log for the overflow warning.
+	droppedLogsCounter = metricsNamespace.NewLabeledCounter("dropped_total", "Number of log entries the gcplogs driver has dropped", "container_id")
+)
+
+func init() {
+	metrics.Register(metricsNamespace)
+}
+
 var (
 	// The number of logs the gcplogs driver has dropped.
 	droppedLogs atomic.Uint64
@@ -41,6 +116,11 @@ var (
 	zone         string
 	instanceName string
 	instanceID   string
+
+	// GKE cluster metadata, populated from the instance's custom metadata
+	// attributes if available.
+	clusterName     string
+	clusterLocation string
 )
 
 func init() {
@@ -58,6 +138,15 @@ type gcplogs struct {
 	logger    *logging.Logger
 	instance  *instanceInfo
 	container *containerInfo
+	logFormat string
+	blocking  bool
+
+	// gcpLabels/trace/spanID come from the gcpLabelsKey/gcpTraceKey/
+	// gcpSpanIDKey extra attributes, if present, and are attached to
+	// every entry alongside whatever gcp-log-format parsing contributes.
+	gcpLabels map[string]string
+	trace     string
+	spanID    string
 }
 
 type dockerLogEntry struct {
@@ -97,6 +186,8 @@ func initGCP() {
 			zone, _ = metadata.ZoneWithContext(ctx)
 			instanceName, _ = metadata.InstanceNameWithContext(ctx)
 			instanceID, _ = metadata.InstanceIDWithContext(ctx)
+			clusterName, _ = metadata.InstanceAttributeValueWithContext(ctx, "cluster-name")
+			clusterLocation, _ = metadata.InstanceAttributeValueWithContext(ctx, "cluster-location")
 		}
 	})
 }
@@ -138,40 +229,64 @@ func New(info logger.Info) (logger.Logger, error) {
 		}
 	}
 
+	resource, err := monitoredResource(info, instanceResource)
+	if err != nil {
+		return nil, err
+	}
 	options := []logging.LoggerOption{}
-	if instanceResource != nil {
-		vmMrpb := logging.CommonResource(
-			&mrpb.MonitoredResource{
-				Type: "gce_instance",
-				Labels: map[string]string{
-					"instance_id": instanceResource.ID,
-					"zone":        instanceResource.Zone,
-				},
-			},
-		)
-		options = []logging.LoggerOption{vmMrpb}
+	if resource != nil {
+		options = append(options, logging.CommonResource(resource))
+	}
+	bufOpts, err := bufferingOptions(info.Config)
+	if err != nil {
+		return nil, err
 	}
+	options = append(options, bufOpts...)
 	lg := c.Logger("gcplogs-docker-driver", options...)
 
 	if err := c.Ping(context.Background()); err != nil {
 		return nil, fmt.Errorf("unable to connect or authenticate with Google Cloud Logging: %v", err)
 	}
 
-	extraAttrs, err := info.ExtraAttributes(nil)
+	extraAttrs, err := extraAttributes(info)
 	if err != nil {
 		return nil, err
 	}
+	gcpLabels, trace, spanID, containerMetadata := splitGCPAttributes(extraAttrs)
+
+	logFormat := info.Config[logFormatOptKey]
+	switch logFormat {
+	case "":
+		logFormat = logFormatRaw
+	case logFormatRaw, logFormatJSON, logFormatGlog:
+	default:
+		return nil, fmt.Errorf("%q is not a valid value for gcp-log-format", logFormat)
+	}
+
+	mode := info.Config[modeOptKey]
+	switch mode {
+	case "", modeNonBlocking:
+		mode = modeNonBlocking
+	case modeBlocking:
+	default:
+		return nil, fmt.Errorf("%q is not a valid value for gcp-mode", mode)
+	}
 
 	l := &gcplogs{
-		client: c,
-		logger: lg,
+		client:    c,
+		logger:    lg,
+		logFormat: logFormat,
+		blocking:  mode == modeBlocking,
+		gcpLabels: gcpLabels,
+		trace:     trace,
+		spanID:    spanID,
 		container: &containerInfo{
 			Name:      info.ContainerName,
 			ID:        info.ContainerID,
 			ImageName: info.ContainerImageName,
 			ImageID:   info.ContainerImageID,
 			Created:   info.ContainerCreated,
-			Metadata:  extraAttrs,
+			Metadata:  containerMetadata,
 		},
 	}
 
@@ -189,6 +304,7 @@ func New(info logger.Info) (logger.Logger, error) {
 	// we overflow and every 1000th time after.
 	c.OnError = func(err error) {
 		if errors.Is(err, logging.ErrOverflow) {
+			droppedLogsCounter.WithValues(info.ContainerID).Inc()
 			if i := droppedLogs.Add(1); i%1000 == 1 {
 				log.G(context.TODO()).Errorf("gcplogs driver has dropped %v logs", i)
 			}
@@ -200,12 +316,252 @@ func New(info logger.Info) (logger.Logger, error) {
 	return l, nil
 }
 
-// ValidateLogOpts validates the opts passed to the gcplogs driver. Currently, the gcplogs
-// driver doesn't take any arguments.
+// monitoredResource picks the MonitoredResource entries logged by this
+// driver should be associated with, honoring an explicit gcp-resource-type
+// override and otherwise auto-detecting: k8s_container if the container
+// carries the labels dockershim/cri-dockerd set for a kubelet-managed pod,
+// else gce_instance if instance metadata was available, else none.
+func monitoredResource(info logger.Info, instanceResource *instanceInfo) (*mrpb.MonitoredResource, error) {
+	switch info.Config[resourceTypeOptKey] {
+	case resourceTypeK8SContainer:
+		res, ok := k8sResourceFrom(info)
+		if !ok {
+			return nil, errors.New("gcp-resource-type=k8s_container requires io.kubernetes.pod.namespace, io.kubernetes.pod.name and io.kubernetes.container.name labels on the container")
+		}
+		return res, nil
+	case resourceTypeGCEInstance:
+		if instanceResource == nil {
+			return nil, errors.New("gcp-resource-type=gce_instance requires instance metadata; specify gcp-meta-zone, gcp-meta-name and gcp-meta-id when not running on GCE")
+		}
+		return gceResource(instanceResource), nil
+	case resourceTypeAuto:
+		if res, ok := k8sResourceFrom(info); ok {
+			return res, nil
+		}
+		if instanceResource != nil {
+			return gceResource(instanceResource), nil
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%q is not a valid value for gcp-resource-type", info.Config[resourceTypeOptKey])
+	}
+}
+
+// k8sResourceFrom builds a k8s_container MonitoredResource from the
+// namespace/pod/container labels dockershim or cri-dockerd set on a
+// container it created on behalf of a kubelet, falling back to the
+// cluster-name/cluster-location instance attributes or their gcp-cluster-*
+// overrides. It reports false if the container doesn't look like a GKE pod.
+func k8sResourceFrom(info logger.Info) (*mrpb.MonitoredResource, bool) {
+	namespace := info.ContainerLabels[k8sNamespaceLabel]
+	podName := info.ContainerLabels[k8sPodNameLabel]
+	containerName := info.ContainerLabels[k8sContainerLabel]
+	if namespace == "" || podName == "" || containerName == "" {
+		return nil, false
+	}
+
+	location := clusterLocation
+	if l, found := info.Config[clusterLocationOptKey]; found {
+		location = l
+	}
+	cluster := clusterName
+	if n, found := info.Config[clusterNameOptKey]; found {
+		cluster = n
+	}
+
+	return &mrpb.MonitoredResource{
+		Type: resourceTypeK8SContainer,
+		Labels: map[string]string{
+			"project_id":     projectID,
+			"location":       location,
+			"cluster_name":   cluster,
+			"namespace_name": namespace,
+			"pod_name":       podName,
+			"container_name": containerName,
+		},
+	}, true
+}
+
+// gceResource builds the gce_instance MonitoredResource matching the
+// gcplogs driver's original, GCE-only behavior.
+func gceResource(instanceResource *instanceInfo) *mrpb.MonitoredResource {
+	return &mrpb.MonitoredResource{
+		Type: resourceTypeGCEInstance,
+		Labels: map[string]string{
+			"instance_id": instanceResource.ID,
+			"zone":        instanceResource.Zone,
+		},
+	}
+}
+
+// bufferingOptions translates the gcp-buffer-size, gcp-buffer-max-bytes,
+// gcp-flush-interval, gcp-entry-count-threshold, gcp-entry-byte-threshold
+// and gcp-concurrent-writes log-opts into the matching logging.LoggerOptions,
+// so callers can trade off Log latency/memory against how aggressively the
+// underlying client batches entries. gcp-buffer-size is a friendlier alias
+// for gcp-entry-count-threshold; if both are set, the latter wins.
+func bufferingOptions(cfg map[string]string) ([]logging.LoggerOption, error) {
+	var options []logging.LoggerOption
+
+	entryCount, ok, err := optInt(cfg, bufferSizeOptKey)
+	if err != nil {
+		return nil, err
+	}
+	if v, set, err := optInt(cfg, entryCountThresholdOptKey); err != nil {
+		return nil, err
+	} else if set {
+		entryCount, ok = v, true
+	}
+	if ok {
+		options = append(options, logging.EntryCountThreshold(entryCount))
+	}
+
+	if v, ok, err := optInt(cfg, entryByteThresholdOptKey); err != nil {
+		return nil, err
+	} else if ok {
+		options = append(options, logging.EntryByteThreshold(v))
+	}
+
+	if v, ok, err := optInt(cfg, bufferMaxBytesOptKey); err != nil {
+		return nil, err
+	} else if ok {
+		options = append(options, logging.BufferedByteLimit(v))
+	}
+
+	if v, ok, err := optInt(cfg, concurrentWritesOptKey); err != nil {
+		return nil, err
+	} else if ok {
+		options = append(options, logging.ConcurrentWriteLimit(v))
+	}
+
+	if raw, ok := cfg[flushIntervalOptKey]; ok {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", flushIntervalOptKey, err)
+		}
+		options = append(options, logging.DelayThreshold(d))
+	}
+
+	return options, nil
+}
+
+// optInt parses cfg[key] as a positive int, reporting false if the key
+// isn't set.
+func optInt(cfg map[string]string, key string) (int, bool, error) {
+	raw, ok := cfg[key]
+	if !ok {
+		return 0, false, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	if v <= 0 {
+		return 0, false, fmt.Errorf("invalid value for %s: must be a positive integer", key)
+	}
+	return v, true, nil
+}
+
+// extraAttributes builds the container's extra attributes from its labels
+// and environment, filtered the same way the jsonfile/gelf/fluentd drivers
+// filter theirs: a key is kept if it's named explicitly in the labels/env
+// opt or matches the labels-regex/env-regex opt.
+func extraAttributes(info logger.Info) (map[string]string, error) {
+	labelsRE, err := optRegexp(info.Config, logLabelsRegexKey)
+	if err != nil {
+		return nil, err
+	}
+	envRE, err := optRegexp(info.Config, logEnvRegexKey)
+	if err != nil {
+		return nil, err
+	}
+	allowLabels := optSet(info.Config[logLabelsKey])
+	allowEnv := optSet(info.Config[logEnvKey])
+
+	extra := map[string]string{}
+	for k, v := range info.ContainerLabels {
+		if allowLabels[k] || (labelsRE != nil && labelsRE.MatchString(k)) {
+			extra[k] = v
+		}
+	}
+	for _, kv := range info.ContainerEnv {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		if allowEnv[k] || (envRE != nil && envRE.MatchString(k)) {
+			extra[k] = v
+		}
+	}
+	return extra, nil
+}
+
+// optSet splits a comma-separated log-opt value into a membership set.
+func optSet(csv string) map[string]bool {
+	if csv == "" {
+		return nil
+	}
+	set := map[string]bool{}
+	for _, v := range strings.Split(csv, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+// optRegexp compiles cfg[key], reporting nil if it's unset.
+func optRegexp(cfg map[string]string, key string) (*regexp.Regexp, error) {
+	v := cfg[key]
+	if v == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	return re, nil
+}
+
+// splitGCPAttributes pulls Cloud Logging's conventional gcpLabelsKey/
+// gcpTraceKey/gcpSpanIDKey out of a container's extra attributes, since
+// those belong on logging.Entry itself rather than buried under Payload.
+// gcpLabelsKey's value is parsed as a JSON object of label key/value
+// pairs; if it doesn't parse, it's left alone in rest rather than
+// failing New outright.
+func splitGCPAttributes(attrs map[string]string) (labels map[string]string, trace, spanID string, rest map[string]string) {
+	rest = make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		rest[k] = v
+	}
+
+	if v, ok := rest[gcpTraceKey]; ok {
+		trace = v
+		delete(rest, gcpTraceKey)
+	}
+	if v, ok := rest[gcpSpanIDKey]; ok {
+		spanID = v
+		delete(rest, gcpSpanIDKey)
+	}
+	if v, ok := rest[gcpLabelsKey]; ok {
+		var parsed map[string]string
+		if err := json.Unmarshal([]byte(v), &parsed); err == nil {
+			labels = parsed
+			delete(rest, gcpLabelsKey)
+		}
+	}
+
+	return labels, trace, spanID, rest
+}
+
+// ValidateLogOpts validates the opts passed to the gcplogs driver.
 func ValidateLogOpts(cfg map[string]string) error {
 	for k := range cfg {
 		switch k {
-		case projectOptKey, logLabelsKey, logLabelsRegexKey, logEnvKey, logEnvRegexKey, logCmdKey, logZoneKey, logNameKey, logIDKey:
+		case projectOptKey, logLabelsKey, logLabelsRegexKey, logEnvKey, logEnvRegexKey, logCmdKey, logZoneKey, logNameKey, logIDKey,
+			resourceTypeOptKey, clusterNameOptKey, clusterLocationOptKey, logFormatOptKey,
+			bufferSizeOptKey, bufferMaxBytesOptKey, flushIntervalOptKey, entryCountThresholdOptKey, entryByteThresholdOptKey,
+			concurrentWritesOptKey, modeOptKey:
 		default:
 			return fmt.Errorf("%q is not a valid option for the gcplogs driver", k)
 		}
@@ -216,19 +572,143 @@ func ValidateLogOpts(cfg map[string]string) error {
 func (l *gcplogs) Log(m *logger.Message) error {
 	message := string(m.Line)
 	ts := m.Timestamp
+	stderr := m.Source == "stderr"
 	logger.PutMessage(m)
 
-	l.logger.Log(logging.Entry{
+	entry := logging.Entry{
 		Timestamp: ts,
+		Severity:  logging.Default,
+		Labels:    l.gcpLabels,
+		Trace:     l.trace,
+		SpanID:    l.spanID,
 		Payload: &dockerLogEntry{
 			Instance:  l.instance,
 			Container: l.container,
 			Message:   message,
 		},
-	})
+	}
+	if stderr {
+		entry.Severity = logging.Warning
+	}
+
+	switch l.logFormat {
+	case logFormatJSON:
+		if parsed, ok := l.jsonEntry(message, ts); ok {
+			entry = parsed
+			if stderr && entry.Severity == logging.Default {
+				entry.Severity = logging.Warning
+			}
+		}
+	case logFormatGlog:
+		if sev, ok := glogSeverity(message); ok {
+			entry.Severity = sev
+		}
+	}
+
+	if l.blocking {
+		return l.logger.LogSync(context.Background(), entry)
+	}
+	l.logger.Log(entry)
 	return nil
 }
 
+// jsonEntry parses message as a JSON object for gcp-log-format=json,
+// promoting recognized fields (severity/level, trace, spanId, time) into
+// the matching logging.Entry field and leaving everything else in
+// Entry.Payload. Instance/container identity, normally nested under
+// Payload in dockerLogEntry, is moved to Entry.Labels instead since Payload
+// is now the caller's own structure. It reports false on anything that
+// isn't a JSON object, so Log can fall back to the raw payload.
+func (l *gcplogs) jsonEntry(message string, ts time.Time) (logging.Entry, bool) {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(message), &fields); err != nil {
+		return logging.Entry{}, false
+	}
+
+	entry := logging.Entry{
+		Timestamp: ts,
+		Severity:  logging.Default,
+		Labels:    l.identityLabels(),
+		Trace:     l.trace,
+		SpanID:    l.spanID,
+	}
+
+	for _, key := range []string{"severity", "level"} {
+		if v, ok := fields[key].(string); ok {
+			entry.Severity = logging.ParseSeverity(v)
+			delete(fields, key)
+			break
+		}
+	}
+	if v, ok := fields["trace"].(string); ok {
+		entry.Trace = v
+		delete(fields, "trace")
+	}
+	if v, ok := fields["spanId"].(string); ok {
+		entry.SpanID = v
+		delete(fields, "spanId")
+	}
+	if v, ok := fields["time"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			entry.Timestamp = t
+		}
+		delete(fields, "time")
+	}
+
+	entry.Payload = fields
+	return entry, true
+}
+
+// identityLabels flattens l.instance/l.container into Entry.Labels, for log
+// formats whose Payload is no longer a dockerLogEntry wrapping them.
+func (l *gcplogs) identityLabels() map[string]string {
+	labels := map[string]string{}
+	for k, v := range l.gcpLabels {
+		labels[k] = v
+	}
+	if l.instance != nil {
+		if l.instance.Zone != "" {
+			labels["instance.zone"] = l.instance.Zone
+		}
+		if l.instance.Name != "" {
+			labels["instance.name"] = l.instance.Name
+		}
+		if l.instance.ID != "" {
+			labels["instance.id"] = l.instance.ID
+		}
+	}
+	if l.container != nil {
+		if l.container.Name != "" {
+			labels["container.name"] = l.container.Name
+		}
+		if l.container.ID != "" {
+			labels["container.id"] = l.container.ID
+		}
+	}
+	return labels
+}
+
+// glogSeverity parses the leading glog severity letter (I/W/E/F) off a log
+// line for gcp-log-format=glog. It reports false for anything else, leaving
+// Log's default/stderr-derived severity in place.
+func glogSeverity(message string) (logging.Severity, bool) {
+	if len(message) == 0 {
+		return logging.Default, false
+	}
+	switch message[0] {
+	case 'I':
+		return logging.Info, true
+	case 'W':
+		return logging.Warning, true
+	case 'E':
+		return logging.Error, true
+	case 'F':
+		return logging.Critical, true
+	default:
+		return logging.Default, false
+	}
+}
+
 func (l *gcplogs) Close() error {
 	l.logger.Flush()
 	return l.client.Close()
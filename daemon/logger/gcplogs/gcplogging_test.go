@@ -0,0 +1,283 @@
+package gcplogs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moby/moby/v2/daemon/logger"
+
+	"cloud.google.com/go/logging"
+	"gotest.tools/v3/assert"
+)
+
+func TestK8sResourceFromRequiresAllThreeLabels(t *testing.T) {
+	cases := []struct {
+		name   string
+		labels map[string]string
+	}{
+		{"no labels", nil},
+		{"namespace only", map[string]string{k8sNamespaceLabel: "ns"}},
+		{"namespace and pod", map[string]string{k8sNamespaceLabel: "ns", k8sPodNameLabel: "pod"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, ok := k8sResourceFrom(logger.Info{ContainerLabels: tc.labels})
+			assert.Assert(t, !ok)
+		})
+	}
+}
+
+func TestK8sResourceFromUsesClusterOverrides(t *testing.T) {
+	info := logger.Info{
+		ContainerLabels: map[string]string{
+			k8sNamespaceLabel: "my-ns",
+			k8sPodNameLabel:   "my-pod",
+			k8sContainerLabel: "my-container",
+		},
+		Config: map[string]string{
+			clusterNameOptKey:     "my-cluster",
+			clusterLocationOptKey: "us-central1",
+		},
+	}
+
+	res, ok := k8sResourceFrom(info)
+	assert.Assert(t, ok)
+	assert.Equal(t, res.Type, resourceTypeK8SContainer)
+	assert.Equal(t, res.Labels["namespace_name"], "my-ns")
+	assert.Equal(t, res.Labels["pod_name"], "my-pod")
+	assert.Equal(t, res.Labels["container_name"], "my-container")
+	assert.Equal(t, res.Labels["cluster_name"], "my-cluster")
+	assert.Equal(t, res.Labels["location"], "us-central1")
+}
+
+func TestGCEResource(t *testing.T) {
+	res := gceResource(&instanceInfo{Zone: "us-east1-b", ID: "123"})
+	assert.Equal(t, res.Type, resourceTypeGCEInstance)
+	assert.Equal(t, res.Labels["zone"], "us-east1-b")
+	assert.Equal(t, res.Labels["instance_id"], "123")
+}
+
+func TestMonitoredResource(t *testing.T) {
+	k8sLabels := map[string]string{
+		k8sNamespaceLabel: "ns",
+		k8sPodNameLabel:   "pod",
+		k8sContainerLabel: "container",
+	}
+	gceInstance := &instanceInfo{Zone: "us-east1-b", ID: "123"}
+
+	cases := []struct {
+		name             string
+		info             logger.Info
+		instanceResource *instanceInfo
+		wantType         string
+		wantErr          string
+	}{
+		{
+			name:     "auto picks k8s over gce when both available",
+			info:     logger.Info{ContainerLabels: k8sLabels},
+			wantType: resourceTypeK8SContainer,
+		},
+		{
+			name:             "auto falls back to gce instance",
+			info:             logger.Info{},
+			instanceResource: gceInstance,
+			wantType:         resourceTypeGCEInstance,
+		},
+		{
+			name: "auto with neither returns no resource",
+			info: logger.Info{},
+		},
+		{
+			name:    "explicit k8s without labels errors",
+			info:    logger.Info{Config: map[string]string{resourceTypeOptKey: resourceTypeK8SContainer}},
+			wantErr: "requires",
+		},
+		{
+			name:    "explicit gce without instance metadata errors",
+			info:    logger.Info{Config: map[string]string{resourceTypeOptKey: resourceTypeGCEInstance}},
+			wantErr: "requires",
+		},
+		{
+			name:    "unrecognized resource type errors",
+			info:    logger.Info{Config: map[string]string{resourceTypeOptKey: "bogus"}},
+			wantErr: "not a valid value",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := monitoredResource(tc.info, tc.instanceResource)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			if tc.wantType == "" {
+				assert.Assert(t, res == nil)
+				return
+			}
+			assert.Equal(t, res.Type, tc.wantType)
+		})
+	}
+}
+
+func TestGlogSeverity(t *testing.T) {
+	cases := []struct {
+		message string
+		want    logging.Severity
+		wantOK  bool
+	}{
+		{"I0101 this is info", logging.Info, true},
+		{"W0101 this is a warning", logging.Warning, true},
+		{"E0101 this is an error", logging.Error, true},
+		{"F0101 this is fatal", logging.Critical, true},
+		{"this has no glog prefix", logging.Default, false},
+		{"", logging.Default, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.message, func(t *testing.T) {
+			sev, ok := glogSeverity(tc.message)
+			assert.Equal(t, ok, tc.wantOK)
+			assert.Equal(t, sev, tc.want)
+		})
+	}
+}
+
+func TestJSONEntryPromotesRecognizedFields(t *testing.T) {
+	l := &gcplogs{trace: "default-trace"}
+	ts := time.Now()
+
+	entry, ok := l.jsonEntry(`{"severity":"ERROR","trace":"req-trace","spanId":"span-1","message":"boom"}`, ts)
+	assert.Assert(t, ok)
+	assert.Equal(t, entry.Severity, logging.Error)
+	assert.Equal(t, entry.Trace, "req-trace")
+	assert.Equal(t, entry.SpanID, "span-1")
+
+	payload, ok := entry.Payload.(map[string]any)
+	assert.Assert(t, ok)
+	assert.Equal(t, payload["message"], "boom")
+	_, stillPresent := payload["severity"]
+	assert.Assert(t, !stillPresent, "promoted fields must not remain in Payload")
+}
+
+func TestJSONEntryFallsBackToDefaultsWhenFieldsAreAbsent(t *testing.T) {
+	l := &gcplogs{trace: "default-trace"}
+	ts := time.Now()
+
+	entry, ok := l.jsonEntry(`{"message":"hello"}`, ts)
+	assert.Assert(t, ok)
+	assert.Equal(t, entry.Severity, logging.Default)
+	assert.Equal(t, entry.Trace, "default-trace")
+	assert.DeepEqual(t, entry.Timestamp, ts)
+}
+
+func TestJSONEntryRejectsNonObjectMessages(t *testing.T) {
+	l := &gcplogs{}
+	_, ok := l.jsonEntry("not json at all", time.Now())
+	assert.Assert(t, !ok)
+}
+
+func TestBufferingOptionsEmptyWithoutOpts(t *testing.T) {
+	opts, err := bufferingOptions(map[string]string{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(opts), 0)
+}
+
+func TestBufferingOptionsEntryCountThresholdOverridesBufferSize(t *testing.T) {
+	// gcp-buffer-size is the friendlier alias for gcp-entry-count-threshold;
+	// when both are set, gcp-entry-count-threshold wins and each produces at
+	// most one EntryCountThreshold option, not two.
+	opts, err := bufferingOptions(map[string]string{
+		bufferSizeOptKey:          "10",
+		entryCountThresholdOptKey: "20",
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, len(opts), 1)
+}
+
+func TestBufferingOptionsCoversAllKnobs(t *testing.T) {
+	opts, err := bufferingOptions(map[string]string{
+		bufferSizeOptKey:         "10",
+		entryByteThresholdOptKey: "1024",
+		bufferMaxBytesOptKey:     "4096",
+		concurrentWritesOptKey:   "4",
+		flushIntervalOptKey:      "2s",
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, len(opts), 5)
+}
+
+func TestBufferingOptionsRejectsInvalidValues(t *testing.T) {
+	cases := map[string]string{
+		bufferSizeOptKey:         "not-a-number",
+		entryByteThresholdOptKey: "not-a-number",
+		bufferMaxBytesOptKey:     "not-a-number",
+		concurrentWritesOptKey:   "not-a-number",
+	}
+	for key, value := range cases {
+		t.Run(key, func(t *testing.T) {
+			_, err := bufferingOptions(map[string]string{key: value})
+			assert.ErrorContains(t, err, "invalid value for "+key)
+		})
+	}
+}
+
+func TestBufferingOptionsRejectsInvalidFlushInterval(t *testing.T) {
+	_, err := bufferingOptions(map[string]string{flushIntervalOptKey: "not-a-duration"})
+	assert.ErrorContains(t, err, "invalid value for "+flushIntervalOptKey)
+}
+
+func TestExtraAttributesFiltersLabelsAndEnv(t *testing.T) {
+	info := logger.Info{
+		Config: map[string]string{
+			logLabelsKey:      "com.example.keep",
+			logLabelsRegexKey: "^com\\.example\\.re-.*",
+			logEnvKey:         "KEEP_ME",
+			logEnvRegexKey:    "^RE_.*",
+		},
+		ContainerLabels: map[string]string{
+			"com.example.keep":    "yes",
+			"com.example.re-dyn":  "yes",
+			"com.example.dropped": "no",
+		},
+		ContainerEnv: []string{
+			"KEEP_ME=yes",
+			"RE_DYNAMIC=yes",
+			"DROPPED=no",
+			"MALFORMED-NO-EQUALS",
+		},
+	}
+
+	extra, err := extraAttributes(info)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, extra, map[string]string{
+		"com.example.keep":   "yes",
+		"com.example.re-dyn": "yes",
+		"KEEP_ME":            "yes",
+		"RE_DYNAMIC":         "yes",
+	})
+}
+
+func TestExtraAttributesRejectsInvalidRegex(t *testing.T) {
+	_, err := extraAttributes(logger.Info{Config: map[string]string{logLabelsRegexKey: "("}})
+	assert.ErrorContains(t, err, "invalid value for "+logLabelsRegexKey)
+
+	_, err = extraAttributes(logger.Info{Config: map[string]string{logEnvRegexKey: "("}})
+	assert.ErrorContains(t, err, "invalid value for "+logEnvRegexKey)
+}
+
+func TestOptSet(t *testing.T) {
+	assert.Assert(t, optSet("") == nil)
+	assert.DeepEqual(t, optSet("a,b, c ,"), map[string]bool{"a": true, "b": true, "c": true})
+}
+
+func TestOptRegexp(t *testing.T) {
+	re, err := optRegexp(map[string]string{"k": ""}, "k")
+	assert.NilError(t, err)
+	assert.Assert(t, re == nil)
+
+	re, err = optRegexp(map[string]string{"k": "^foo"}, "k")
+	assert.NilError(t, err)
+	assert.Assert(t, re.MatchString("foobar"))
+	assert.Assert(t, !re.MatchString("barfoo"))
+}
@@ -0,0 +1,274 @@
+//go:build linux || freebsd
+
+package daemon
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/containerd/log"
+	"github.com/moby/moby/v2/daemon/container"
+	"github.com/moby/moby/v2/errdefs"
+	"github.com/pkg/errors"
+)
+
+// Secrets driver names for HostConfig.SecretsDriver / the daemon-wide
+// default configured in daemon.json.
+const (
+	SecretsDriverTmpfs    = "tmpfs"
+	SecretsDriverRamfs    = "ramfs"
+	SecretsDriverExternal = "external"
+)
+
+// defaultSecretsDriver is the daemon-wide fallback used when a container
+// doesn't set HostConfig.SecretsDriver, configured from daemon.json's
+// secrets-driver option. The config plumbing that assigns it lives
+// outside this checkout; it defaults to SecretsDriverTmpfs.
+var defaultSecretsDriver = SecretsDriverTmpfs
+
+// SecretsProvider provisions and tears down the directory a container's
+// secrets and configs are injected into. It replaces the previously
+// hard-coded tmpfs-only behavior so alternative backends - a ramfs mount
+// whose pages are never swappable, or material fetched from an external
+// plugin - can be selected per container.
+type SecretsProvider interface {
+	// Setup creates the container's secrets directory and populates it
+	// with the container's declared secrets/configs.
+	Setup(ctr *container.Container) error
+	// Remount finalizes the directory as read-only once Setup has
+	// populated it.
+	Remount(ctr *container.Container) error
+	// Cleanup tears the directory down, on container removal or on a
+	// failed Setup.
+	Cleanup(ctr *container.Container)
+}
+
+// secretsProviderFor selects the SecretsProvider for ctr from
+// ctr.HostConfig.SecretsDriver, falling back to defaultSecretsDriver.
+func (daemon *Daemon) secretsProviderFor(ctr *container.Container) (SecretsProvider, error) {
+	driver := ctr.HostConfig.SecretsDriver
+	if driver == "" {
+		driver = defaultSecretsDriver
+	}
+
+	switch driver {
+	case SecretsDriverTmpfs:
+		return &mountSecretsProvider{daemon: daemon, fsType: "tmpfs"}, nil
+	case SecretsDriverRamfs:
+		return &mountSecretsProvider{daemon: daemon, fsType: "ramfs"}, nil
+	case SecretsDriverExternal:
+		client, ok := lookupSecretsProviderPlugin(ctr.HostConfig.SecretsDriverPlugin)
+		if !ok {
+			return nil, errdefs.InvalidParameter(errors.Errorf("no external secrets provider plugin %q registered", ctr.HostConfig.SecretsDriverPlugin))
+		}
+		return &externalSecretsProvider{daemon: daemon, client: client}, nil
+	default:
+		return nil, errdefs.InvalidParameter(errors.Errorf("%q is not a valid secrets driver", driver))
+	}
+}
+
+// mountSecretsProvider is the historical tmpfs behavior generalized to any
+// in-kernel filesystem createSecretsDir/remountSecretDir know how to
+// mount - currently "tmpfs" and "ramfs". ramfs has no size limit and its
+// pages can never be swapped out, which is what container runtimes
+// generally recommend for secret material, at the cost of tmpfs's size
+// accounting: a runaway writer can exhaust memory outright.
+type mountSecretsProvider struct {
+	daemon *Daemon
+	fsType string
+}
+
+func (p *mountSecretsProvider) Setup(ctr *container.Container) error {
+	if err := p.daemon.createSecretsDir(ctr, p.fsType); err != nil {
+		return err
+	}
+	return p.daemon.injectSecretsAndConfigs(ctr)
+}
+
+func (p *mountSecretsProvider) Remount(ctr *container.Container) error {
+	return p.daemon.remountSecretDir(ctr, p.fsType)
+}
+
+func (p *mountSecretsProvider) Cleanup(ctr *container.Container) {
+	p.daemon.cleanupSecretDir(ctr)
+}
+
+// SecretsProviderClient is the subset of an external secrets-provider
+// plugin's gRPC API a SecretsProvider needs: fetch material for a
+// secret/config reference, rotate or revoke it, and subscribe to
+// rotations so the daemon can rewrite the file in place instead of
+// restarting the container. A plugin implements this by generating a
+// client from the provider's protobuf definition; neither the .proto nor
+// the generated stubs are part of this checkout.
+type SecretsProviderClient interface {
+	Get(ctx context.Context, id string) ([]byte, error)
+	Rotate(ctx context.Context, id string) error
+	Revoke(ctx context.Context, id string) error
+	Subscribe(ctx context.Context, id string) (<-chan []byte, error)
+}
+
+var (
+	secretsProviderPluginsMu sync.Mutex
+	secretsProviderPlugins   = map[string]SecretsProviderClient{}
+)
+
+// RegisterSecretsProviderPlugin makes a Docker plugin implementing the
+// external SecretsProvider gRPC API selectable via
+// HostConfig.SecretsDriver=SecretsDriverExternal,
+// HostConfig.SecretsDriverPlugin=name. The plugin discovery code that
+// calls this at daemon startup lives outside this checkout.
+func RegisterSecretsProviderPlugin(name string, client SecretsProviderClient) {
+	secretsProviderPluginsMu.Lock()
+	defer secretsProviderPluginsMu.Unlock()
+	secretsProviderPlugins[name] = client
+}
+
+func lookupSecretsProviderPlugin(name string) (SecretsProviderClient, bool) {
+	secretsProviderPluginsMu.Lock()
+	defer secretsProviderPluginsMu.Unlock()
+	client, ok := secretsProviderPlugins[name]
+	return client, ok
+}
+
+// externalSecretsProvider fetches secret/config material from a plugin at
+// container start instead of ctr.DependencyStore, which is why
+// DependencyStore is optional when this provider is in use. It keeps a
+// subscription open per injected reference for the container's lifetime
+// so a rotation on the plugin side rewrites the file without a container
+// restart.
+type externalSecretsProvider struct {
+	daemon *Daemon
+	client SecretsProviderClient
+
+	mu     sync.Mutex
+	cancel []context.CancelFunc
+
+	// remountMu serializes the remount-rw/write/remount-ro bracket in
+	// writeRotated, since setupSecretDir remounts the container's
+	// secrets tmpfs read-only once Setup returns and every reference's
+	// rotation goroutine shares that same directory's mount state.
+	remountMu sync.Mutex
+}
+
+func (p *externalSecretsProvider) Setup(ctr *container.Container) error {
+	if err := p.daemon.createSecretsDir(ctr, "tmpfs"); err != nil {
+		return err
+	}
+
+	for _, s := range ctr.SecretReferences {
+		if s.File == nil {
+			continue
+		}
+		fPath, err := ctr.SecretFilePath(*s)
+		if err != nil {
+			return errors.Wrap(err, "error getting secret file path")
+		}
+		if err := p.fetchAndWatch(ctr, s.SecretID, fPath, s.File.Mode); err != nil {
+			return errors.Wrapf(err, "fetching secret %s from external provider", s.File.Name)
+		}
+	}
+	for _, c := range ctr.ConfigReferences {
+		if c.File == nil {
+			continue
+		}
+		fPath, err := ctr.ConfigFilePath(*c)
+		if err != nil {
+			return errors.Wrap(err, "error getting config file path")
+		}
+		if err := p.fetchAndWatch(ctr, c.ConfigID, fPath, c.File.Mode); err != nil {
+			return errors.Wrapf(err, "fetching config %s from external provider", c.File.Name)
+		}
+	}
+	return nil
+}
+
+// fetchAndWatch writes id's current material to fPath and, if the plugin
+// supports it, starts a goroutine that rewrites fPath whenever the plugin
+// reports a rotation, for as long as ctr keeps running.
+func (p *externalSecretsProvider) fetchAndWatch(ctr *container.Container, id, fPath string, mode os.FileMode) error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	data, err := p.client.Get(ctx, id)
+	if err != nil {
+		cancel()
+		return err
+	}
+	if err := os.WriteFile(fPath, data, mode); err != nil {
+		cancel()
+		return errors.Wrap(err, "error injecting secret")
+	}
+
+	updates, err := p.client.Subscribe(ctx, id)
+	if err != nil {
+		// Rotation isn't supported by every plugin; the material we
+		// already fetched and wrote is still good for the container's
+		// lifetime.
+		cancel()
+		return nil
+	}
+
+	p.mu.Lock()
+	p.cancel = append(p.cancel, cancel)
+	p.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case data, ok := <-updates:
+				if !ok {
+					return
+				}
+				if err := p.writeRotated(ctr, fPath, data, mode); err != nil {
+					log.G(ctx).WithError(err).WithFields(log.Fields{
+						"container": ctr.ID,
+						"path":      fPath,
+					}).Error("error rewriting rotated secret")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// writeRotated rewrites fPath with newly rotated secret/config material.
+// setupSecretDir remounts the container's secrets tmpfs read-only right
+// after Setup returns, so the directory has to be remounted read-write
+// for the duration of the write and back to read-only afterwards -
+// otherwise every rotation after the first Setup fails with EROFS and is
+// silently dropped.
+func (p *externalSecretsProvider) writeRotated(ctr *container.Container, fPath string, data []byte, mode os.FileMode) error {
+	p.remountMu.Lock()
+	defer p.remountMu.Unlock()
+
+	if err := p.daemon.remountSecretDirRW(ctr, "tmpfs"); err != nil {
+		return errors.Wrap(err, "error remounting secrets dir read-write for rotation")
+	}
+	defer func() {
+		if err := p.daemon.remountSecretDir(ctr, "tmpfs"); err != nil {
+			log.G(context.TODO()).WithError(err).WithField("container", ctr.ID).Error("error remounting secrets dir read-only after rotation")
+		}
+	}()
+
+	if err := os.WriteFile(fPath, data, mode); err != nil {
+		return errors.Wrap(err, "error rewriting rotated secret")
+	}
+	return nil
+}
+
+func (p *externalSecretsProvider) Remount(ctr *container.Container) error {
+	return p.daemon.remountSecretDir(ctr, "tmpfs")
+}
+
+func (p *externalSecretsProvider) Cleanup(ctr *container.Container) {
+	p.mu.Lock()
+	cancels := p.cancel
+	p.cancel = nil
+	p.mu.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+	p.daemon.cleanupSecretDir(ctr)
+}
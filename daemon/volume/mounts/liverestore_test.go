@@ -0,0 +1,110 @@
+package mounts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mounttypes "github.com/moby/moby/api/types/mount"
+	"github.com/moby/moby/v2/daemon/internal/idtools"
+	"gotest.tools/v3/assert"
+)
+
+// liveRestoreVolume is a dirVolume that also implements volume.LiveRestorer,
+// so it can stand in for a real volume driver across a simulated daemon
+// restart.
+type liveRestoreVolume struct {
+	dirVolume
+	restoredID string
+}
+
+func (v *liveRestoreVolume) LiveRestoreVolume(ctx context.Context, id string) error {
+	v.restoredID = id
+	return nil
+}
+
+// TestMountPointLiveRestoreSubpath simulates a daemon restart mid-`docker
+// cp` into a TypeVolume-with-Subpath mount: only the fields persisted on
+// MountPoint survive (the live safepath.SafePath handles don't), and
+// LiveRestore must reopen and re-validate the subpath from that state.
+func TestMountPointLiveRestoreSubpath(t *testing.T) {
+	restorer := &liveRestoreVolume{dirVolume: dirVolume{name: "v", path: t.TempDir()}}
+	assert.NilError(t, os.Mkdir(filepath.Join(restorer.path, "sub"), 0o755))
+
+	m := &MountPoint{
+		Type:   mounttypes.TypeVolume,
+		Source: restorer.name,
+		Volume: restorer,
+		Spec: mounttypes.Mount{
+			VolumeOptions: &mounttypes.VolumeOptions{Subpath: "sub"},
+		},
+	}
+
+	ctx := context.Background()
+	_, cleanup, err := m.Setup(ctx, "", idtools.Identity{}, nil)
+	assert.NilError(t, err)
+	defer cleanup(ctx)
+
+	assert.Equal(t, len(m.SafePaths), 1)
+	persisted := m.SafePaths[0]
+
+	// Only what's JSON-serializable on MountPoint survives a restart.
+	restored := &MountPoint{
+		Type:      m.Type,
+		Source:    m.Source,
+		Volume:    restorer,
+		ID:        m.ID,
+		Spec:      m.Spec,
+		SafePaths: []PersistedSafePath{persisted},
+	}
+
+	assert.NilError(t, restored.LiveRestore(ctx))
+	assert.Equal(t, restorer.restoredID, m.ID)
+	assert.Equal(t, len(restored.SafePaths), 1)
+	assert.Equal(t, restored.Stale, false)
+}
+
+// TestMountPointLiveRestoreSubpathStaleAfterTargetMoved covers the case
+// where the subpath was replaced (e.g. swapped for a symlink) while the
+// daemon was down: LiveRestore must refuse to hand back the path and mark
+// the mount Stale so the caller stops the container instead of continuing
+// with a possibly-compromised path.
+func TestMountPointLiveRestoreSubpathStaleAfterTargetMoved(t *testing.T) {
+	restorer := &liveRestoreVolume{dirVolume: dirVolume{name: "v", path: t.TempDir()}}
+	assert.NilError(t, os.Mkdir(filepath.Join(restorer.path, "sub"), 0o755))
+
+	m := &MountPoint{
+		Type:   mounttypes.TypeVolume,
+		Source: restorer.name,
+		Volume: restorer,
+		Spec: mounttypes.Mount{
+			VolumeOptions: &mounttypes.VolumeOptions{Subpath: "sub"},
+		},
+	}
+
+	ctx := context.Background()
+	_, cleanup, err := m.Setup(ctx, "", idtools.Identity{}, nil)
+	assert.NilError(t, err)
+	defer cleanup(ctx)
+
+	persisted := m.SafePaths[0]
+
+	// While the daemon is down, "sub" is replaced with a symlink elsewhere
+	// in the volume, so it now resolves to a different path than before.
+	assert.NilError(t, os.RemoveAll(filepath.Join(restorer.path, "sub")))
+	assert.NilError(t, os.Symlink(restorer.path, filepath.Join(restorer.path, "sub")))
+
+	restored := &MountPoint{
+		Type:      m.Type,
+		Source:    m.Source,
+		Volume:    restorer,
+		ID:        m.ID,
+		Spec:      m.Spec,
+		SafePaths: []PersistedSafePath{persisted},
+	}
+
+	err = restored.LiveRestore(ctx)
+	assert.ErrorContains(t, err, "stale")
+	assert.Equal(t, restored.Stale, true)
+}
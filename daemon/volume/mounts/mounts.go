@@ -3,7 +3,8 @@ package mounts
 import (
 	"context"
 	"path/filepath"
-	"runtime/debug"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/containerd/log"
@@ -32,6 +33,28 @@ type RWLayer interface {
 	Metadata() (map[string]string, error)
 }
 
+// PersistedSafePath is the on-disk projection of a safepath.SafePath handle
+// created by Setup, recorded so LiveRestore can reopen and re-validate it
+// across a daemon restart.
+type PersistedSafePath struct {
+	// Base is the path the subpath was joined against (e.g. the volume's
+	// mount path, or a bind/image mount's Source).
+	Base string
+	// Subpath is the user-requested path relative to Base.
+	Subpath string
+	// ResolvedPath is the fully-resolved path safepath.Join returned the
+	// last time this handle was (re-)opened.
+	ResolvedPath string
+}
+
+// trackedSafePath pairs a live safepath.SafePath with the fields needed to
+// persist and later re-open it.
+type trackedSafePath struct {
+	safePath *safepath.SafePath
+	base     string
+	subpath  string
+}
+
 // MountPoint is the intersection point between a volume and a container. It
 // specifies which volume is to be used and where inside a container it should
 // be mounted.
@@ -86,60 +109,245 @@ type MountPoint struct {
 	// where a bind dir existed during validation was removed before reaching the setup code.
 	SkipMountpointCreation bool
 
+	// OverlayLowers are the sources stacked as an overlayfs `lowerdir=`, in
+	// priority order (first entry highest), when Type == mounttypes.TypeOverlay.
+	// Each one is set up through the normal MountPoint plumbing, so
+	// refcounting, subpath safety and SELinux relabeling apply per layer.
+	OverlayLowers []*MountPoint
+	// OverlayUpper optionally provides the overlay's `upperdir=`, making the
+	// overlay writable. Only used when Type == mounttypes.TypeOverlay.
+	OverlayUpper *MountPoint
+	// OverlayDir is the daemon-managed directory under which the merged and
+	// work directories for an overlay mount are created. It must be set by
+	// the caller before Setup is called on a TypeOverlay mount.
+	OverlayDir string
+	// overlayMergedDir is the overlayfs merged directory returned by the
+	// most recent successful overlay setup, or "" if the overlay isn't
+	// currently mounted.
+	overlayMergedDir string
+
+	// mu guards active, ID and safePaths against concurrent Setup/Cleanup
+	// calls (e.g. a running container and a concurrent `docker cp` both
+	// mounting the same volume).
+	mu sync.Mutex
+
 	// Track usage of this mountpoint
 	// Specifically needed for containers which are running and calls to `docker cp`
 	// because both these actions require mounting the volumes.
 	active int
 
-	// SafePaths created by Setup that should be cleaned up before unmounting
-	// the volume.
-	safePaths []*safepath.SafePath
+	// mounting is non-nil while a m.Volume.Mount call for the current
+	// session is in flight. Concurrent Setup calls that find it set wait on
+	// its done channel and reuse its result instead of each generating
+	// their own ID and racing a separate Mount call (moby#46508).
+	mounting *volumeMountState
+
+	// mountingOverlay is the overlay analogue of mounting: non-nil while a
+	// setupOverlay build for the current session is in flight, so
+	// concurrent callers share the one build instead of each assembling
+	// (and then tearing down) their own overlay.
+	mountingOverlay *overlayMountState
+
+	// SafePaths is the on-disk projection of safePaths: enough information
+	// (base, subpath, and the path they resolved to) to reopen and
+	// re-validate each handle via LiveRestore after a daemon restart, since
+	// the live safepath.SafePath values hold fds and cannot themselves be
+	// persisted.
+	SafePaths []PersistedSafePath `json:",omitempty"`
+
+	// Stale is set by LiveRestore when a persisted SafePath no longer
+	// resolves to the path it did before the daemon restarted (e.g. the
+	// subpath was replaced with a symlink while the daemon was down).
+	// Callers must treat a stale mount as compromised and stop the
+	// container rather than continue using it.
+	Stale bool `json:",omitempty"`
+
+	// safePaths created by Setup that should be cleaned up before
+	// unmounting the volume. Kept in lockstep with SafePaths.
+	safePaths []trackedSafePath
+
+	// releaseFunc, if set, is invoked by release on the transition to zero
+	// active users instead of the default m.Volume.Unmount(id). It backs
+	// composite mount types (e.g. overlay) whose teardown does more than
+	// unmount a single volume.
+	releaseFunc func(context.Context) error
 
 	Layer RWLayer `json:"-"`
 }
 
-// Cleanup frees resources used by the mountpoint and cleans up all the paths
-// returned by Setup that hasn't been cleaned up by the caller.
-func (m *MountPoint) Cleanup(ctx context.Context) error {
-	if m.Volume == nil || m.ID == "" {
-		return nil
-	}
-
-	logger := log.G(ctx).WithFields(log.Fields{"active": m.active, "id": m.ID})
+// acquire records a new user of the mountpoint's volume, to be matched by a
+// later call to release (directly or via Cleanup).
+func (m *MountPoint) acquire() {
+	m.mu.Lock()
+	m.active++
+	m.mu.Unlock()
+}
 
-	// TODO: Remove once the real bug is fixed: https://github.com/moby/moby/issues/46508
+// release drops one reference acquired by acquire. It is safe to call
+// release more times than acquire: the surplus calls are no-ops rather than
+// driving active negative. The underlying volume is only unmounted, and ID
+// only cleared, on the transition from one active user to zero.
+func (m *MountPoint) release(ctx context.Context) error {
+	m.mu.Lock()
 	if m.active == 0 {
-		logger.Error("An attempt to decrement a zero mount count")
-		logger.Error(string(debug.Stack()))
+		m.mu.Unlock()
+		return nil
+	}
+	m.active--
+	if m.active > 0 {
+		m.mu.Unlock()
 		return nil
 	}
+	safePaths := m.safePaths
+	m.safePaths = nil
+	m.SafePaths = nil
+	id := m.ID
+	m.ID = ""
+	releaseFunc := m.releaseFunc
+	m.releaseFunc = nil
+	m.mu.Unlock()
 
-	for _, p := range m.safePaths {
-		if !p.IsValid() {
+	for _, tp := range safePaths {
+		if !tp.safePath.IsValid() {
 			continue
 		}
 
-		err := p.Close(ctx)
-		base, sub := p.SourcePath()
+		err := tp.safePath.Close(ctx)
 		log.G(ctx).WithFields(log.Fields{
 			"error":         err,
-			"path":          p.Path(),
-			"sourceBase":    base,
-			"sourceSubpath": sub,
+			"path":          tp.safePath.Path(),
+			"sourceBase":    tp.base,
+			"sourceSubpath": tp.subpath,
 		}).Warn("cleaning up SafePath that hasn't been cleaned up by the caller")
 	}
 
-	if err := m.Volume.Unmount(m.ID); err != nil {
+	if releaseFunc != nil {
+		return releaseFunc(ctx)
+	}
+
+	if m.Volume == nil || id == "" {
+		return nil
+	}
+	if err := m.Volume.Unmount(id); err != nil {
 		return errors.Wrapf(err, "error unmounting volume %s", m.Volume.Name())
 	}
+	return nil
+}
 
-	m.active--
-	logger.Debug("MountPoint.Cleanup Decrement active count")
+// volumeMountState is the in-flight or completed result of a single
+// m.Volume.Mount call, shared by every Setup call racing to mount the same
+// session.
+type volumeMountState struct {
+	done chan struct{}
+	id   string
+	path string
+	err  error
+}
 
-	if m.active == 0 {
-		m.ID = ""
+// ensureVolumeMounted claims the opaque ID passed to m.Volume.Mount and
+// calls Mount at most once per session: the first caller to arrive
+// publishes a volumeMountState and does the Mount, and every concurrent
+// caller that arrives before it finishes waits on that same state instead
+// of generating its own ID and driving a second Mount call (moby#46508).
+func (m *MountPoint) ensureVolumeMounted() (path, id string, err error) {
+	m.mu.Lock()
+	if st := m.mounting; st != nil {
+		m.mu.Unlock()
+		<-st.done
+		return st.path, st.id, st.err
 	}
-	return nil
+
+	id = m.ID
+	if id == "" {
+		id = stringid.GenerateRandomID()
+	}
+	st := &volumeMountState{done: make(chan struct{}), id: id}
+	m.mounting = st
+	m.mu.Unlock()
+
+	path, err = m.Volume.Mount(id)
+
+	m.mu.Lock()
+	st.path, st.err = path, err
+	if err == nil {
+		m.ID = id
+	}
+	m.mounting = nil
+	m.mu.Unlock()
+	close(st.done)
+
+	return path, id, err
+}
+
+// trackSafePath records p (created by safepath.Join(ctx, base, subpath)) so
+// it is closed if it's still open when the mountpoint is released, and
+// persisted so LiveRestore can reopen and re-validate it after a daemon
+// restart. The returned cleanup closes p directly and untracks it; it's
+// independent of, and safe to call alongside, the mountpoint's own
+// acquire/release bookkeeping.
+func (m *MountPoint) trackSafePath(p *safepath.SafePath, base, subpath string) func(context.Context) error {
+	m.mu.Lock()
+	m.safePaths = append(m.safePaths, trackedSafePath{safePath: p, base: base, subpath: subpath})
+	m.SafePaths = append(m.SafePaths, PersistedSafePath{Base: base, Subpath: subpath, ResolvedPath: p.Path()})
+	m.mu.Unlock()
+
+	return onceCleanup(func(ctx context.Context) error {
+		err := p.Close(ctx)
+		m.mu.Lock()
+		m.safePaths = dropTrackedSafePath(m.safePaths, p)
+		m.SafePaths = dropPersistedSafePath(m.SafePaths, base, subpath)
+		m.mu.Unlock()
+		return err
+	})
+}
+
+func dropTrackedSafePath(paths []trackedSafePath, target *safepath.SafePath) []trackedSafePath {
+	out := paths[:0]
+	for _, p := range paths {
+		if p.safePath != target {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func dropPersistedSafePath(paths []PersistedSafePath, base, subpath string) []PersistedSafePath {
+	out := paths[:0]
+	for _, p := range paths {
+		if p.Base != base || p.Subpath != subpath {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// onceCleanup wraps a cleanup function so repeated calls (e.g. from both a
+// caller's explicit cleanup and a deferred one on an error path) run the
+// underlying cleanup exactly once.
+func onceCleanup(f func(context.Context) error) func(context.Context) error {
+	var (
+		once sync.Once
+		err  error
+	)
+	return func(ctx context.Context) error {
+		once.Do(func() { err = f(ctx) })
+		return err
+	}
+}
+
+// Cleanup releases the caller's handle on the mountpoint's volume. It is the
+// caller-facing counterpart to the Setup call that acquired the handle:
+// calling it is always safe, including calling it more times than Setup was
+// called, or concurrently with other Cleanup/Setup calls. The underlying
+// volume is only unmounted once every handle has been released.
+func (m *MountPoint) Cleanup(ctx context.Context) error {
+	m.mu.Lock()
+	tracked := m.Volume != nil || m.releaseFunc != nil
+	m.mu.Unlock()
+	if !tracked {
+		return nil
+	}
+	return m.release(ctx)
 }
 
 // Setup sets up a mount point by either mounting the volume if it is
@@ -185,36 +393,41 @@ func (m *MountPoint) Setup(ctx context.Context, mountLabel string, rootIDs idtoo
 		}
 	}()
 
+	if m.Type == mounttypes.TypeOverlay {
+		return m.setupOverlay(ctx, mountLabel, rootIDs, checkFun)
+	}
+
 	if m.Volume != nil {
-		id := m.ID
-		if id == "" {
-			id = stringid.GenerateRandomID()
-		}
-		volumePath, err := m.Volume.Mount(id)
+		volumePath, _, err := m.ensureVolumeMounted()
 		if err != nil {
 			return "", noCleanup, errors.Wrapf(err, "error while mounting volume '%s'", m.Source)
 		}
 
-		m.ID = id
 		clean := noCleanup
 		if m.Spec.VolumeOptions != nil && m.Spec.VolumeOptions.Subpath != "" {
 			subpath := m.Spec.VolumeOptions.Subpath
 
 			safePath, err := safepath.Join(ctx, volumePath, subpath)
 			if err != nil {
-				if err := m.Volume.Unmount(id); err != nil {
-					log.G(ctx).WithError(err).Error("failed to unmount after safepath.Join failed")
+				// Route the teardown through acquire/release instead of
+				// calling m.Volume.Unmount(id) directly: another
+				// concurrent Setup call may have already acquired this
+				// same volume mount (ensureVolumeMounted shares it across
+				// racing callers) and still be relying on it, and only
+				// release knows whether this caller's is the last handle.
+				m.acquire()
+				if relErr := m.release(ctx); relErr != nil {
+					log.G(ctx).WithError(relErr).Error("failed to release volume after safepath.Join failed")
 				}
 				return "", noCleanup, err
 			}
-			m.safePaths = append(m.safePaths, safePath)
 			log.G(ctx).Debugf("mounting (%s|%s) via %s", volumePath, subpath, safePath.Path())
 
-			clean = safePath.Close
+			clean = m.trackSafePath(safePath, volumePath, subpath)
 			volumePath = safePath.Path()
 		}
 
-		m.active++
+		m.acquire()
 		return volumePath, clean, nil
 	}
 
@@ -226,9 +439,8 @@ func (m *MountPoint) Setup(ctx context.Context, mountLabel string, rootIDs idtoo
 			if err != nil {
 				return "", noCleanup, err
 			}
-			m.safePaths = append(m.safePaths, safePath)
 			log.G(ctx).Debugf("mounting (%s|%s) via %s", m.Source, subpath, safePath.Path())
-			return safePath.Path(), safePath.Close, nil
+			return safePath.Path(), m.trackSafePath(safePath, m.Source, subpath), nil
 		}
 	}
 
@@ -261,14 +473,36 @@ func (m *MountPoint) Setup(ctx context.Context, mountLabel string, rootIDs idtoo
 				return "", noCleanup, errors.Wrapf(err, "error while creating mount source path '%s'", m.Source)
 			}
 		}
+
+		if m.Spec.BindOptions != nil && m.Spec.BindOptions.Subpath != "" {
+			subpath := m.Spec.BindOptions.Subpath
+			if err := validateSubpath(subpath); err != nil {
+				return "", noCleanup, err
+			}
+
+			safePath, err := safepath.Join(ctx, m.Source, subpath)
+			if err != nil {
+				return "", noCleanup, err
+			}
+			log.G(ctx).Debugf("mounting (%s|%s) via %s", m.Source, subpath, safePath.Path())
+			return safePath.Path(), m.trackSafePath(safePath, m.Source, subpath), nil
+		}
 	}
 	return m.Source, noCleanup, nil
 }
 
+// subpathLiveRestorer is an optional extension of volume.LiveRestorer,
+// implemented by drivers that need to react when one of their subpath
+// mounts survives a daemon restart (e.g. to re-pin a kernel-side handle),
+// mirroring LiveRestoreVolume itself.
+type subpathLiveRestorer interface {
+	LiveRestoreSubpath(ctx context.Context, id, subpath string) error
+}
+
 func (m *MountPoint) LiveRestore(ctx context.Context) error {
 	if m.Volume == nil {
 		log.G(ctx).Debug("No volume to restore")
-		return nil
+		return m.liveRestoreSafePaths(ctx, nil, "")
 	}
 
 	lrv, ok := m.Volume.(volume.LiveRestorer)
@@ -277,20 +511,85 @@ func (m *MountPoint) LiveRestore(ctx context.Context) error {
 		return nil
 	}
 
+	m.mu.Lock()
 	id := m.ID
 	if id == "" {
 		id = stringid.GenerateRandomID()
 	}
+	m.mu.Unlock()
 
 	if err := lrv.LiveRestoreVolume(ctx, id); err != nil {
 		return errors.Wrapf(err, "error while restoring volume '%s'", m.Source)
 	}
 
+	m.mu.Lock()
 	m.ID = id
-	m.active++
+	m.mu.Unlock()
+	m.acquire()
+
+	return m.liveRestoreSafePaths(ctx, lrv, id)
+}
+
+// liveRestoreSafePaths re-opens every SafePath persisted across a daemon
+// restart, re-validating that each subpath still resolves to the same
+// target it did before the daemon stopped. A mismatch means the target
+// moved while the daemon was down (e.g. a symlink swap) and the path can no
+// longer be trusted, so the mount is marked Stale and restore fails rather
+// than silently handing back a path that may now point somewhere else
+// (TOCTOU). lrv may be nil (e.g. for TypeImage/TypeBind subpaths, which
+// have no associated volume.LiveRestorer).
+func (m *MountPoint) liveRestoreSafePaths(ctx context.Context, lrv volume.LiveRestorer, id string) error {
+	m.mu.Lock()
+	persisted := m.SafePaths
+	m.mu.Unlock()
+	if len(persisted) == 0 {
+		return nil
+	}
+
+	sr, _ := lrv.(subpathLiveRestorer)
+
+	fresh := make([]trackedSafePath, 0, len(persisted))
+	stillValid := make([]PersistedSafePath, 0, len(persisted))
+	for _, p := range persisted {
+		safePath, err := safepath.Join(ctx, p.Base, p.Subpath)
+		if err != nil {
+			m.markStale(ctx, p, err)
+			return errors.Wrapf(err, "mount %q is stale: subpath %q no longer resolves", m.Destination, p.Subpath)
+		}
+		if safePath.Path() != p.ResolvedPath {
+			err := errors.Errorf("subpath %q now resolves to %q, previously %q", p.Subpath, safePath.Path(), p.ResolvedPath)
+			m.markStale(ctx, p, err)
+			return errors.Wrapf(err, "mount %q is stale", m.Destination)
+		}
+		if sr != nil {
+			if err := sr.LiveRestoreSubpath(ctx, id, p.Subpath); err != nil {
+				return errors.Wrapf(err, "error restoring subpath %q on volume '%s'", p.Subpath, m.Source)
+			}
+		}
+		fresh = append(fresh, trackedSafePath{safePath: safePath, base: p.Base, subpath: p.Subpath})
+		stillValid = append(stillValid, PersistedSafePath{Base: p.Base, Subpath: p.Subpath, ResolvedPath: safePath.Path()})
+	}
+
+	m.mu.Lock()
+	m.safePaths = fresh
+	m.SafePaths = stillValid
+	m.mu.Unlock()
 	return nil
 }
 
+// markStale flags m as no longer trustworthy after a failed LiveRestore
+// check. Callers are expected to stop the container rather than continue
+// using a stale mount.
+func (m *MountPoint) markStale(ctx context.Context, p PersistedSafePath, cause error) {
+	m.mu.Lock()
+	m.Stale = true
+	m.mu.Unlock()
+	log.G(ctx).WithError(cause).WithFields(log.Fields{
+		"destination": m.Destination,
+		"subpath":     p.Subpath,
+	}).Error("mount is stale after live restore; forcing container stop")
+}
+
 // Path returns the path of a volume in a mount point.
 func (m *MountPoint) Path() string {
 	if m.Volume != nil {
@@ -307,6 +606,20 @@ func errInvalidSpec(spec string) error {
 	return errors.Errorf("invalid volume specification: '%s'", spec)
 }
 
+// validateSubpath rejects subpaths that are obviously malformed before
+// they're handed to safepath.Join, which is responsible for the definitive
+// (symlink-aware) escape check.
+func validateSubpath(subpath string) error {
+	if filepath.IsAbs(subpath) {
+		return errors.Errorf("invalid subpath: '%s': must be relative", subpath)
+	}
+	cleaned := filepath.Clean(subpath)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return errors.Errorf("invalid subpath: '%s': must not escape the mount source", subpath)
+	}
+	return nil
+}
+
 // noCleanup is a no-op cleanup function.
 func noCleanup(_ context.Context) error {
 	return nil
@@ -0,0 +1,95 @@
+package mounts
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/v2/daemon/internal/idtools"
+)
+
+// countingVolume is a minimal volume.Volume that records how many times
+// Mount/Unmount actually ran, so tests can assert the driver only sees one
+// mount/unmount pair no matter how many concurrent Setup/Cleanup calls came
+// in above it.
+type countingVolume struct {
+	mounts   atomic.Int32
+	unmounts atomic.Int32
+}
+
+func (v *countingVolume) Name() string       { return "test-volume" }
+func (v *countingVolume) DriverName() string { return "test" }
+func (v *countingVolume) Path() string       { return "/test-volume" }
+
+func (v *countingVolume) Mount(id string) (string, error) {
+	v.mounts.Add(1)
+	return v.Path(), nil
+}
+
+func (v *countingVolume) Unmount(id string) error {
+	v.unmounts.Add(1)
+	return nil
+}
+
+func (v *countingVolume) Status() map[string]interface{} { return nil }
+func (v *countingVolume) CreatedAt() (time.Time, error)  { return time.Time{}, nil }
+
+// TestMountPointConcurrentSetupCleanup runs N concurrent Setup/Cleanup pairs
+// against the same MountPoint and asserts the underlying volume only ever
+// sees a single Mount/Unmount pair, and that Cleanup never errors even when
+// called more times than Setup (https://github.com/moby/moby/issues/46508).
+func TestMountPointConcurrentSetupCleanup(t *testing.T) {
+	const n = 100
+
+	vol := &countingVolume{}
+	m := &MountPoint{Volume: vol}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx := context.Background()
+			_, cleanup, err := m.Setup(ctx, "", idtools.Identity{}, nil)
+			if err != nil {
+				t.Errorf("Setup: %v", err)
+				return
+			}
+
+			// Call the returned cleanup twice: it must be idempotent, and
+			// must not be confused with the active-count release below.
+			if err := cleanup(ctx); err != nil {
+				t.Errorf("cleanup: %v", err)
+			}
+			if err := cleanup(ctx); err != nil {
+				t.Errorf("cleanup (second call): %v", err)
+			}
+
+			// Release this goroutine's handle on the volume. Calling it
+			// twice must be a safe no-op, not a crash or a stray unmount.
+			if err := m.Cleanup(ctx); err != nil {
+				t.Errorf("Cleanup: %v", err)
+			}
+			if err := m.Cleanup(ctx); err != nil {
+				t.Errorf("Cleanup (second call): %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := vol.mounts.Load(); got != 1 {
+		t.Errorf("expected exactly 1 Mount call, got %d", got)
+	}
+	if got := vol.unmounts.Load(); got != 1 {
+		t.Errorf("expected exactly 1 Unmount call, got %d", got)
+	}
+	if m.active != 0 {
+		t.Errorf("expected active count to be 0, got %d", m.active)
+	}
+	if m.ID != "" {
+		t.Errorf("expected ID to be cleared, got %q", m.ID)
+	}
+}
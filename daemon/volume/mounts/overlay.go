@@ -0,0 +1,185 @@
+package mounts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/moby/moby/v2/daemon/internal/idtools"
+	"github.com/moby/moby/v2/daemon/internal/stringid"
+	"github.com/moby/sys/mount"
+	"github.com/pkg/errors"
+)
+
+// overlayMountState is the in-flight or completed result of a single overlay
+// build, shared by every setupOverlay call racing to assemble the same
+// session, mirroring volumeMountState/ensureVolumeMounted (moby#46508).
+type overlayMountState struct {
+	done      chan struct{}
+	mergedDir string
+	err       error
+}
+
+// setupOverlay assembles m.OverlayLowers (and, if set, m.OverlayUpper) into a
+// single overlayfs mount rooted at m.OverlayDir. Each source is set up
+// through the normal MountPoint.Setup plumbing, so refcounting, subpath
+// safety and SELinux relabeling apply to every layer exactly as they would
+// if it were mounted on its own. If any source fails to mount, every source
+// that already succeeded is torn down before returning, so a failed overlay
+// setup never leaves stray mounts behind.
+//
+// Concurrent calls that arrive while a build is in flight wait for it and
+// share its result instead of each assembling (and then tearing down) their
+// own overlay, the same way concurrent volume Setup calls share a single
+// ensureVolumeMounted build.
+func (m *MountPoint) setupOverlay(ctx context.Context, mountLabel string, rootIDs idtools.Identity, checkFun func(m *MountPoint) error) (string, func(context.Context) error, error) {
+	m.mu.Lock()
+	if m.overlayMergedDir != "" {
+		dir := m.overlayMergedDir
+		m.active++
+		m.mu.Unlock()
+		return dir, onceCleanup(m.release), nil
+	}
+	if st := m.mountingOverlay; st != nil {
+		m.mu.Unlock()
+		<-st.done
+		if st.err != nil {
+			return "", noCleanup, st.err
+		}
+		m.acquire()
+		return st.mergedDir, onceCleanup(m.release), nil
+	}
+
+	if len(m.OverlayLowers) == 0 {
+		m.mu.Unlock()
+		return "", noCleanup, errors.New("overlay mount requires at least one lower source")
+	}
+	if m.OverlayDir == "" {
+		m.mu.Unlock()
+		return "", noCleanup, errors.New("overlay mount requires OverlayDir to be set")
+	}
+
+	id := m.ID
+	if id == "" {
+		id = stringid.GenerateRandomID()
+	}
+	st := &overlayMountState{done: make(chan struct{})}
+	m.mountingOverlay = st
+	m.mu.Unlock()
+
+	mergedDir, releaseFunc, err := m.buildOverlay(ctx, mountLabel, rootIDs, checkFun, id)
+
+	m.mu.Lock()
+	st.mergedDir, st.err = mergedDir, err
+	if err == nil {
+		m.ID = id
+		m.overlayMergedDir = mergedDir
+		m.releaseFunc = releaseFunc
+	}
+	m.mountingOverlay = nil
+	m.mu.Unlock()
+	close(st.done)
+
+	if err != nil {
+		return "", noCleanup, err
+	}
+
+	m.acquire()
+	return mergedDir, onceCleanup(m.release), nil
+}
+
+// buildOverlay does the actual work of mounting m.OverlayLowers (and, if
+// set, m.OverlayUpper) into a single overlayfs mount rooted at
+// m.OverlayDir, returning the merged directory and a releaseFunc that tears
+// it down. It touches no MountPoint state directly; the caller is
+// responsible for publishing the result under m.mu.
+func (m *MountPoint) buildOverlay(ctx context.Context, mountLabel string, rootIDs idtools.Identity, checkFun func(m *MountPoint) error, id string) (string, func(context.Context) error, error) {
+	root := filepath.Join(m.OverlayDir, id)
+	mergedDir := filepath.Join(root, "merged")
+	if err := os.MkdirAll(mergedDir, 0o700); err != nil {
+		return "", noCleanup, errors.Wrapf(err, "error creating overlay merged dir '%s'", mergedDir)
+	}
+
+	type overlaySource struct {
+		source  string
+		cleanup func(context.Context) error
+	}
+	var sources []overlaySource
+	// releaseSource pairs the cleanup Setup returned for src (which only
+	// closes its safepath handles) with src.Cleanup, which releases the
+	// volume reference Setup acquired.
+	releaseSource := func(src *MountPoint, cln func(context.Context) error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			err := cln(ctx)
+			if relErr := src.Cleanup(ctx); err == nil {
+				err = relErr
+			}
+			return err
+		}
+	}
+	unwind := func() {
+		for i := len(sources) - 1; i >= 0; i-- {
+			if err := sources[i].cleanup(ctx); err != nil {
+				log.G(ctx).WithError(err).WithField("source", sources[i].source).Warn("failed to clean up overlay source after a later source failed to mount")
+			}
+		}
+	}
+
+	lowerPaths := make([]string, 0, len(m.OverlayLowers))
+	for _, lower := range m.OverlayLowers {
+		path, cln, err := lower.Setup(ctx, mountLabel, rootIDs, checkFun)
+		if err != nil {
+			unwind()
+			return "", noCleanup, errors.Wrapf(err, "error setting up overlay lower '%s'", lower.Source)
+		}
+		sources = append(sources, overlaySource{lower.Source, releaseSource(lower, cln)})
+		lowerPaths = append(lowerPaths, path)
+	}
+
+	var upperDir, workDir string
+	if m.OverlayUpper != nil {
+		path, cln, err := m.OverlayUpper.Setup(ctx, mountLabel, rootIDs, checkFun)
+		if err != nil {
+			unwind()
+			return "", noCleanup, errors.Wrapf(err, "error setting up overlay upper '%s'", m.OverlayUpper.Source)
+		}
+		sources = append(sources, overlaySource{m.OverlayUpper.Source, releaseSource(m.OverlayUpper, cln)})
+		upperDir = path
+		workDir = filepath.Join(root, "work")
+		if err := os.MkdirAll(workDir, 0o700); err != nil {
+			unwind()
+			return "", noCleanup, errors.Wrapf(err, "error creating overlay work dir '%s'", workDir)
+		}
+	}
+
+	opts := "lowerdir=" + strings.Join(lowerPaths, ":")
+	if upperDir != "" {
+		opts += ",upperdir=" + upperDir + ",workdir=" + workDir
+	}
+	if err := mount.Mount("overlay", mergedDir, "overlay", opts); err != nil {
+		unwind()
+		return "", noCleanup, errors.Wrapf(err, "error mounting overlay at '%s'", mergedDir)
+	}
+
+	releaseFunc := func(ctx context.Context) error {
+		unmountErr := mount.Unmount(mergedDir)
+		// Sources are released in reverse order, after the overlay itself
+		// is gone, so nothing is still referencing them while they unwind.
+		for i := len(sources) - 1; i >= 0; i-- {
+			if err := sources[i].cleanup(ctx); err != nil {
+				log.G(ctx).WithError(err).WithField("source", sources[i].source).Warn("failed to clean up overlay source")
+			}
+		}
+		m.mu.Lock()
+		m.overlayMergedDir = ""
+		m.mu.Unlock()
+		if unmountErr != nil {
+			return errors.Wrapf(unmountErr, "error unmounting overlay at '%s'", mergedDir)
+		}
+		return nil
+	}
+
+	return mergedDir, releaseFunc, nil
+}
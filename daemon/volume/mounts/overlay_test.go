@@ -0,0 +1,147 @@
+package mounts
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mounttypes "github.com/moby/moby/api/types/mount"
+	"github.com/moby/moby/v2/daemon/internal/idtools"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/skip"
+)
+
+// dirVolume is a volume.Volume backed by a real directory on disk, so it can
+// be used as an overlayfs lower/upper layer in tests.
+type dirVolume struct {
+	name string
+	path string
+
+	mounts   atomic.Int32
+	unmounts atomic.Int32
+}
+
+func (v *dirVolume) Name() string       { return v.name }
+func (v *dirVolume) DriverName() string { return "test" }
+func (v *dirVolume) Path() string       { return v.path }
+
+func (v *dirVolume) Mount(id string) (string, error) {
+	v.mounts.Add(1)
+	return v.path, nil
+}
+
+func (v *dirVolume) Unmount(id string) error {
+	v.unmounts.Add(1)
+	return nil
+}
+
+func (v *dirVolume) Status() map[string]interface{} { return nil }
+func (v *dirVolume) CreatedAt() (time.Time, error)  { return time.Time{}, nil }
+
+func newDirVolume(t *testing.T, name string) *dirVolume {
+	t.Helper()
+	return &dirVolume{name: name, path: t.TempDir()}
+}
+
+func requireOverlaySupport(t *testing.T) {
+	t.Helper()
+	skip.If(t, os.Getuid() != 0, "overlay mounts require root")
+}
+
+func TestMountPointOverlayTwoVolumes(t *testing.T) {
+	requireOverlaySupport(t)
+
+	lowerA := newDirVolume(t, "lower-a")
+	lowerB := newDirVolume(t, "lower-b")
+	assert.NilError(t, os.WriteFile(filepath.Join(lowerA.path, "from-a"), []byte("a"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(lowerB.path, "from-b"), []byte("b"), 0o644))
+
+	m := &MountPoint{
+		Type:       mounttypes.TypeOverlay,
+		OverlayDir: t.TempDir(),
+		OverlayLowers: []*MountPoint{
+			{Type: mounttypes.TypeVolume, Source: lowerA.name, Volume: lowerA},
+			{Type: mounttypes.TypeVolume, Source: lowerB.name, Volume: lowerB},
+		},
+	}
+
+	ctx := context.Background()
+	path, cleanup, err := m.Setup(ctx, "", idtools.Identity{}, nil)
+	assert.NilError(t, err)
+
+	_, err = os.Stat(filepath.Join(path, "from-a"))
+	assert.NilError(t, err)
+	_, err = os.Stat(filepath.Join(path, "from-b"))
+	assert.NilError(t, err)
+
+	assert.NilError(t, cleanup(ctx))
+	assert.Equal(t, lowerA.unmounts.Load(), int32(1))
+	assert.Equal(t, lowerB.unmounts.Load(), int32(1))
+}
+
+func TestMountPointOverlayBindUpper(t *testing.T) {
+	requireOverlaySupport(t)
+
+	lower := newDirVolume(t, "lower")
+	assert.NilError(t, os.WriteFile(filepath.Join(lower.path, "from-lower"), []byte("x"), 0o644))
+	upperSrc := t.TempDir()
+
+	m := &MountPoint{
+		Type:       mounttypes.TypeOverlay,
+		OverlayDir: t.TempDir(),
+		OverlayLowers: []*MountPoint{
+			{Type: mounttypes.TypeVolume, Source: lower.name, Volume: lower},
+		},
+		OverlayUpper: &MountPoint{Type: mounttypes.TypeBind, Source: upperSrc},
+	}
+
+	ctx := context.Background()
+	path, cleanup, err := m.Setup(ctx, "", idtools.Identity{}, nil)
+	assert.NilError(t, err)
+
+	assert.NilError(t, os.WriteFile(filepath.Join(path, "written-through-upper"), []byte("y"), 0o644))
+	_, err = os.Stat(filepath.Join(upperSrc, "written-through-upper"))
+	assert.NilError(t, err, "writes through the merged dir should land in the upperdir")
+
+	assert.NilError(t, cleanup(ctx))
+}
+
+// failingVolume fails Mount, used to simulate a lower source that can't be
+// set up partway through overlay assembly.
+type failingVolume struct {
+	dirVolume
+}
+
+func (v *failingVolume) Mount(id string) (string, error) {
+	return "", errors.New("simulated mount failure")
+}
+
+func TestMountPointOverlayPartialFailureNoStrayMounts(t *testing.T) {
+	// No real overlayfs mount is ever attempted here (the second lower
+	// fails before we get that far), so unlike the other overlay tests this
+	// doesn't need root.
+	good := newDirVolume(t, "good")
+	bad := &failingVolume{dirVolume{name: "bad", path: t.TempDir()}}
+
+	m := &MountPoint{
+		Type:       mounttypes.TypeOverlay,
+		OverlayDir: t.TempDir(),
+		OverlayLowers: []*MountPoint{
+			{Type: mounttypes.TypeVolume, Source: good.name, Volume: good},
+			{Type: mounttypes.TypeVolume, Source: bad.name, Volume: bad},
+		},
+	}
+
+	ctx := context.Background()
+	_, _, err := m.Setup(ctx, "", idtools.Identity{}, nil)
+	assert.ErrorContains(t, err, "error setting up overlay lower")
+
+	// The first lower succeeded before the second failed: it must have been
+	// torn down again rather than left mounted.
+	assert.Equal(t, good.mounts.Load(), good.unmounts.Load())
+	assert.Equal(t, m.overlayMergedDir, "")
+}
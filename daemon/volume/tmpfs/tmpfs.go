@@ -0,0 +1,300 @@
+// Package tmpfs provides a volume.Driver that backs named volumes with a
+// tmpfs mount instead of a directory on disk, so tmpfs storage can be
+// shared across containers and refcounted the same way bind/local volumes
+// are, instead of being handled as a one-off TypeTmpfs mount.
+package tmpfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/moby/moby/v2/daemon/volume"
+	"github.com/moby/sys/mount"
+)
+
+// DriverName is the name this driver registers itself under.
+const DriverName = "tmpfs"
+
+// Register makes a tmpfs Driver rooted at root available to the volume
+// drivers registry under DriverName, so volumes created with
+// `--driver tmpfs` are handled by this package.
+func Register(root string, store volume.DriverStore) error {
+	d, err := New(root)
+	if err != nil {
+		return err
+	}
+	return store.Register(d, DriverName)
+}
+
+// Driver implements volume.Driver, materializing each named volume as its
+// own tmpfs mount.
+type Driver struct {
+	root string
+
+	mu      sync.Mutex
+	volumes map[string]*Volume
+}
+
+// New creates a Driver that stores per-volume mount points under root
+// (typically <daemon-root>/volumes/tmpfs), restoring the opts of any
+// volume that was created by a previous daemon run so a restart recreates
+// the tmpfs with the same options on next Mount.
+func New(root string) (*Driver, error) {
+	if err := os.MkdirAll(root, 0o701); err != nil {
+		return nil, fmt.Errorf("creating tmpfs volumes root: %w", err)
+	}
+	d := &Driver{root: root, volumes: map[string]*Volume{}}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("listing tmpfs volumes: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), optsSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), optsSuffix)
+		opts, err := readOpts(filepath.Join(root, entry.Name()))
+		if err != nil {
+			log.G(context.TODO()).WithError(err).WithField("volume", name).Warn("tmpfs volume driver: failed to restore saved options")
+			continue
+		}
+		d.volumes[name] = &Volume{driver: d, name: name, mountOpts: opts, path: filepath.Join(root, name)}
+	}
+	return d, nil
+}
+
+// optsSuffix names the sidecar file that persists a volume's mount opts so
+// they survive a daemon restart (the tmpfs itself, of course, does not).
+const optsSuffix = ".opts"
+
+func readOpts(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (d *Driver) saveOpts(name, opts string) error {
+	return os.WriteFile(filepath.Join(d.root, name+optsSuffix), []byte(opts), 0o600)
+}
+
+// Name returns the name of the driver.
+func (d *Driver) Name() string { return DriverName }
+
+// Create creates a new tmpfs-backed volume with the given opts. Supported
+// opts mirror the mount(8) triple Podman exposes: "type" (must be "tmpfs"
+// if set), "device" (must be "tmpfs" if set), and "o" (a comma-separated
+// list of tmpfs mount options, e.g. "nodev,noexec,size=64m").
+func (d *Driver) Create(name string, opts map[string]string) (volume.Volume, error) {
+	mountOpts, err := parseOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v, ok := d.volumes[name]; ok {
+		return v, nil
+	}
+
+	if err := d.saveOpts(name, mountOpts); err != nil {
+		return nil, fmt.Errorf("persisting tmpfs volume options: %w", err)
+	}
+
+	v := &Volume{
+		driver:    d,
+		name:      name,
+		mountOpts: mountOpts,
+		path:      filepath.Join(d.root, name),
+	}
+	d.volumes[name] = v
+	return v, nil
+}
+
+// Remove removes v and its saved options. It returns an error, and removes
+// nothing, while v is still mounted.
+func (d *Driver) Remove(v volume.Volume) error {
+	tv, ok := v.(*Volume)
+	if !ok {
+		return fmt.Errorf("unknown volume type %T", v)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tv.mu.Lock()
+	mounted := tv.refCount > 0
+	tv.mu.Unlock()
+	if mounted {
+		return fmt.Errorf("volume %s is still in use", tv.name)
+	}
+
+	if err := os.RemoveAll(tv.path); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(d.root, tv.name+optsSuffix)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(d.volumes, tv.name)
+	return nil
+}
+
+// List returns all tmpfs volumes known to the driver.
+func (d *Driver) List() ([]volume.Volume, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	vols := make([]volume.Volume, 0, len(d.volumes))
+	for _, v := range d.volumes {
+		vols = append(vols, v)
+	}
+	return vols, nil
+}
+
+// Get returns the volume with the given name.
+func (d *Driver) Get(name string) (volume.Volume, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.volumes[name]
+	if !ok {
+		return nil, fmt.Errorf("get %s: no such volume", name)
+	}
+	return v, nil
+}
+
+// Scope returns "local": a tmpfs volume only makes sense on the host that
+// created it.
+func (d *Driver) Scope() string { return "local" }
+
+// parseOpts validates the driver opts accepted by Create, rejecting
+// anything that isn't the tmpfs mount(8) triple or fails to parse (e.g. a
+// malformed size).
+func parseOpts(opts map[string]string) (string, error) {
+	for k, v := range opts {
+		switch k {
+		case "type":
+			if v != "tmpfs" {
+				return "", fmt.Errorf("unsupported type %q for tmpfs volume driver", v)
+			}
+		case "device":
+			if v != "tmpfs" {
+				return "", fmt.Errorf("unsupported device %q for tmpfs volume driver", v)
+			}
+		case "o":
+			// validated below
+		default:
+			return "", fmt.Errorf("unknown option %q for tmpfs volume driver", k)
+		}
+	}
+
+	o := opts["o"]
+	for _, field := range strings.Split(o, ",") {
+		if field == "" {
+			continue
+		}
+		if kv := strings.SplitN(field, "=", 2); len(kv) == 2 && kv[0] == "size" {
+			if _, err := parseSize(kv[1]); err != nil {
+				return "", fmt.Errorf("invalid size option %q: %w", kv[1], err)
+			}
+		}
+	}
+	return o, nil
+}
+
+// parseSize does a best-effort parse of a mount(8)-style size (e.g. "64m",
+// "2g"), just enough to reject garbage at Create time.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			mult, s = 1024, s[:n-1]
+		case 'm', 'M':
+			mult, s = 1024*1024, s[:n-1]
+		case 'g', 'G':
+			mult, s = 1024*1024*1024, s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// Volume is a single tmpfs-backed volume.Volume.
+type Volume struct {
+	driver    *Driver
+	name      string
+	path      string
+	mountOpts string
+
+	mu       sync.Mutex
+	refCount int
+}
+
+// Name returns the volume's name.
+func (v *Volume) Name() string { return v.name }
+
+// DriverName returns the name of the driver that created this volume.
+func (v *Volume) DriverName() string { return DriverName }
+
+// Path returns the volume's mount point on the host.
+func (v *Volume) Path() string { return v.path }
+
+// Mount mounts the volume's tmpfs (if not already mounted for another
+// caller) and returns its path.
+func (v *Volume) Mount(id string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.refCount == 0 {
+		if err := os.MkdirAll(v.path, 0o755); err != nil {
+			return "", fmt.Errorf("creating tmpfs volume mount point: %w", err)
+		}
+		if err := mount.Mount("tmpfs", v.path, "tmpfs", v.mountOpts); err != nil {
+			return "", fmt.Errorf("mounting tmpfs volume %s: %w", v.name, err)
+		}
+	}
+	v.refCount++
+	return v.path, nil
+}
+
+// Unmount decrements the volume's reference count, unmounting the tmpfs
+// once the last caller releases it.
+func (v *Volume) Unmount(id string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.refCount == 0 {
+		log.G(context.TODO()).WithField("volume", v.name).Warn("tmpfs volume: unmount called with a zero reference count")
+		return nil
+	}
+	v.refCount--
+	if v.refCount > 0 {
+		return nil
+	}
+	return mount.Unmount(v.path)
+}
+
+// Status reports the tmpfs mount options the volume was created with.
+func (v *Volume) Status() map[string]interface{} {
+	return map[string]interface{}{
+		"Options": v.mountOpts,
+	}
+}
+
+// CreatedAt is not persisted for tmpfs volumes, which are ephemeral by
+// nature; it returns the zero time.
+func (v *Volume) CreatedAt() (time.Time, error) {
+	return time.Time{}, nil
+}
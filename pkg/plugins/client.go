@@ -2,11 +2,16 @@ package plugins
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/containerd/log"
@@ -62,32 +67,89 @@ func newTransport(addr string, tlsConfig *tlsconfig.Options) (*transport.HTTPTra
 }
 
 // NewClient creates a new plugin client (http).
-func NewClient(addr string, tlsConfig *tlsconfig.Options) (*Client, error) {
+func NewClient(addr string, tlsConfig *tlsconfig.Options, opts ...ClientOpt) (*Client, error) {
 	clientTransport, err := newTransport(addr, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
-	return newClientWithTransport(clientTransport, 0), nil
+	return newClientWithTransport(addr, clientTransport, 0, opts...), nil
 }
 
 // NewClientWithTimeout creates a new plugin client (http).
-func NewClientWithTimeout(addr string, tlsConfig *tlsconfig.Options, timeout time.Duration) (*Client, error) {
+func NewClientWithTimeout(addr string, tlsConfig *tlsconfig.Options, timeout time.Duration, opts ...ClientOpt) (*Client, error) {
 	clientTransport, err := newTransport(addr, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
-	return newClientWithTransport(clientTransport, timeout), nil
+	return newClientWithTransport(addr, clientTransport, timeout, opts...), nil
+}
+
+// NewClientWithRetry creates a new plugin client (http) that uses rc as
+// its default retry policy instead of defaultRetryConfig. A request may
+// still override it with WithRetryConfig.
+func NewClientWithRetry(addr string, tlsConfig *tlsconfig.Options, rc RetryConfig, timeout time.Duration, opts ...ClientOpt) (*Client, error) {
+	clientTransport, err := newTransport(addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	c := newClientWithTransport(addr, clientTransport, timeout, opts...)
+	c.retryConfig = &rc
+	return c, nil
+}
+
+// ClientOpt configures optional Client behavior, applied by NewClient,
+// NewClientWithTimeout, and NewClientWithRetry.
+type ClientOpt func(*Client)
+
+// WithCompression enables gzip compression of request bodies sent to
+// the plugin, and always advertises Accept-Encoding: gzip so a
+// compressed response can be read back. Plugins may not support a
+// compressed request; one that answers 415 Unsupported Media Type is
+// remembered per-endpoint and subsequent calls to that same
+// serviceMethod fall back to uncompressed.
+func WithCompression(c Compression) ClientOpt {
+	return func(cl *Client) {
+		cl.compression = c
+	}
+}
+
+// WithRoundTripper layers mw around the client's underlying transport,
+// preserving the dummy-host and unix/npipe socket configuration
+// newTransport already set up. Useful for observability middleware such
+// as otelhttp.NewTransport, NewPrometheusRoundTripper, or a per-plugin
+// circuit breaker.
+func WithRoundTripper(mw func(http.RoundTripper) http.RoundTripper) ClientOpt {
+	return WithRoundTrippers(mw)
+}
+
+// WithRoundTrippers is like WithRoundTripper, but layers multiple
+// middlewares in the order given: each wraps the result of the one
+// before it, so the last middleware is outermost and sees a request
+// first.
+func WithRoundTrippers(mws ...func(http.RoundTripper) http.RoundTripper) ClientOpt {
+	return func(c *Client) {
+		rt := c.http.Transport
+		for _, mw := range mws {
+			rt = mw(rt)
+		}
+		c.http.Transport = rt
+	}
 }
 
 // newClientWithTransport creates a new plugin client with a given transport.
-func newClientWithTransport(tr *transport.HTTPTransport, timeout time.Duration) *Client {
-	return &Client{
+func newClientWithTransport(addr string, tr *transport.HTTPTransport, timeout time.Duration, opts ...ClientOpt) *Client {
+	c := &Client{
+		addr: addr,
 		http: &http.Client{
 			Transport: tr,
 			Timeout:   timeout,
 		},
 		requestFactory: tr,
 	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
 }
 
 // requestFactory defines an interface that transports can implement to
@@ -96,17 +158,174 @@ type requestFactory interface {
 	NewRequest(path string, data io.Reader) (*http.Request, error)
 }
 
+// ContextKey is the type of the context keys callWithRetry sets on every
+// outgoing request, so RoundTripper middleware installed via
+// WithRoundTripper/WithRoundTrippers can label metrics or spans without
+// parsing the request URL.
+type ContextKey string
+
+const (
+	// ServiceMethodContextKey holds the serviceMethod (the plugin's API
+	// path) passed to Call/Stream/SendFile and their variants.
+	ServiceMethodContextKey ContextKey = "plugin-service-method"
+	// PluginAddrContextKey holds the plugin address the Client was
+	// constructed with.
+	PluginAddrContextKey ContextKey = "plugin-addr"
+)
+
 // Client represents a plugin client.
 type Client struct {
+	addr           string       // plugin address, as passed to NewClient
 	http           *http.Client // http client to use
 	requestFactory requestFactory
+
+	// retryConfig is the client's default retry policy. A nil value
+	// means defaultRetryConfig.
+	retryConfig *RetryConfig
+
+	// compression is the client's request-compression setting, set via
+	// WithCompression.
+	compression Compression
+
+	compressionMu sync.Mutex
+	// compressionUnsupported records serviceMethods a plugin has told
+	// us, via a 415 response, it can't accept a compressed request
+	// for - so later calls to that endpoint skip straight to
+	// uncompressed instead of renegotiating every time.
+	compressionUnsupported map[string]bool
+}
+
+// Compression selects whether a plugin request body is gzip-compressed.
+type Compression int
+
+const (
+	// CompressionNone sends uncompressed request bodies. This is the
+	// default. Requests still advertise Accept-Encoding: gzip, and a
+	// gzip-encoded response is decompressed before it is returned.
+	CompressionNone Compression = iota
+	// CompressionGzip gzip-compresses request bodies and advertises
+	// Accept-Encoding: gzip for the response.
+	CompressionGzip
+)
+
+func (c *Client) isCompressionUnsupported(serviceMethod string) bool {
+	c.compressionMu.Lock()
+	defer c.compressionMu.Unlock()
+	return c.compressionUnsupported[serviceMethod]
+}
+
+func (c *Client) markCompressionUnsupported(serviceMethod string) {
+	c.compressionMu.Lock()
+	defer c.compressionMu.Unlock()
+	if c.compressionUnsupported == nil {
+		c.compressionUnsupported = map[string]bool{}
+	}
+	c.compressionUnsupported[serviceMethod] = true
+}
+
+// gzipWriterPool and gzipReaderPool avoid a per-call allocation for
+// compressing requests and decompressing responses, since plugin calls
+// (auth, volume, network drivers) can be very hot paths.
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() interface{} { return gzip.NewWriter(io.Discard) },
+	}
+	gzipReaderPool = sync.Pool{
+		New: func() interface{} { return new(gzip.Reader) },
+	}
+)
+
+// gzipCompress gzip-compresses raw using a pooled gzip.Writer.
+func gzipCompress(raw []byte) ([]byte, error) {
+	gw := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(gw)
+
+	var buf bytes.Buffer
+	gw.Reset(&buf)
+	if _, err := gw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipReadCloser decompresses a gzip-encoded response body, returning
+// its underlying gzip.Reader to gzipReaderPool and closing the
+// undecompressed body on Close.
+type gzipReadCloser struct {
+	io.Reader
+	gz   *gzip.Reader
+	body io.ReadCloser
+}
+
+func newGzipReadCloser(body io.ReadCloser) (io.ReadCloser, error) {
+	gz := gzipReaderPool.Get().(*gzip.Reader)
+	if err := gz.Reset(body); err != nil {
+		gzipReaderPool.Put(gz)
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: gz, gz: gz, body: body}, nil
+}
+
+func (g *gzipReadCloser) Close() error {
+	err := g.gz.Close()
+	gzipReaderPool.Put(g.gz)
+	if bodyErr := g.body.Close(); err == nil {
+		err = bodyErr
+	}
+	return err
+}
+
+// RetryConfig controls how a plugin request is retried, either because
+// it couldn't be sent at all (a transport error) or because the plugin
+// responded with a status in RetryableStatuses.
+//
+// The zero value is not directly usable; NewClient and friends fall back
+// to defaultRetryConfig, which reproduces this client's historical
+// behavior: exponential doubling from 1s capped at 30s, no jitter, and
+// no retrying on HTTP status.
+type RetryConfig struct {
+	// InitialInterval is the backoff before the first retry.
+	InitialInterval time.Duration
+	// MaxInterval caps the computed backoff, and any Retry-After value
+	// honored from a plugin's response.
+	MaxInterval time.Duration
+	// MaxElapsedTime bounds the total time spent retrying, measured
+	// from the first attempt. Retrying stops once the next backoff
+	// would push the elapsed time past it.
+	MaxElapsedTime time.Duration
+	// Multiplier is applied to the previous backoff to compute the
+	// next one, before jitter.
+	Multiplier float64
+	// RandomizationFactor jitters each computed backoff uniformly in
+	// [interval*(1-RandomizationFactor), interval*(1+RandomizationFactor)].
+	// Zero disables jitter.
+	RandomizationFactor float64
+	// RetryableStatuses are the HTTP statuses, in addition to a
+	// transport-level error, that trigger a retry.
+	RetryableStatuses []int
+}
+
+// defaultRetryConfig is used whenever neither the client nor a
+// per-request RequestOpts supplies a RetryConfig.
+var defaultRetryConfig = RetryConfig{
+	InitialInterval: 1 * time.Second,
+	MaxInterval:     defaultTimeOut,
+	MaxElapsedTime:  defaultTimeOut,
+	Multiplier:      2,
 }
 
 // RequestOpts is the set of options that can be passed into a request
 type RequestOpts struct {
 	Timeout time.Duration
 
-	// testTimeOut is used during tests to limit the max timeout in [abort]
+	// RetryConfig overrides the client's retry policy for this request.
+	RetryConfig *RetryConfig
+
+	// testTimeOut is used during tests to limit the max elapsed retry
+	// time in [retryBackoff.next]
 	testTimeOut time.Duration
 }
 
@@ -117,28 +336,42 @@ func WithRequestTimeout(t time.Duration) func(*RequestOpts) {
 	}
 }
 
+// WithRetryConfig overrides the client's retry policy for one request.
+func WithRetryConfig(rc *RetryConfig) func(*RequestOpts) {
+	return func(o *RequestOpts) {
+		o.RetryConfig = rc
+	}
+}
+
 // Call calls the specified method with the specified arguments for the plugin.
 // It will retry for 30 seconds if a failure occurs when calling.
 func (c *Client) Call(serviceMethod string, args, ret interface{}) error {
-	return c.CallWithOptions(serviceMethod, args, ret)
+	return c.CallContext(context.Background(), serviceMethod, args, ret)
 }
 
 // CallWithOptions is just like call except it takes options
 func (c *Client) CallWithOptions(serviceMethod string, args interface{}, ret interface{}, opts ...func(*RequestOpts)) error {
+	return c.CallContext(context.Background(), serviceMethod, args, ret, opts...)
+}
+
+// CallContext is like CallWithOptions, but takes a context that cancels
+// the plugin request - including any retries - when the caller's own
+// operation is cancelled or times out.
+func (c *Client) CallContext(ctx context.Context, serviceMethod string, args interface{}, ret interface{}, opts ...func(*RequestOpts)) error {
 	var buf bytes.Buffer
 	if args != nil {
 		if err := json.NewEncoder(&buf).Encode(args); err != nil {
 			return err
 		}
 	}
-	body, err := c.callWithRetry(serviceMethod, &buf, true, opts...)
+	body, err := c.callWithRetry(ctx, serviceMethod, &buf, true, opts...)
 	if err != nil {
 		return err
 	}
 	defer body.Close()
 	if ret != nil {
 		if err := json.NewDecoder(body).Decode(&ret); err != nil {
-			log.G(context.TODO()).Errorf("%s: error reading plugin resp: %v", serviceMethod, err)
+			log.G(ctx).Errorf("%s: error reading plugin resp: %v", serviceMethod, err)
 			return err
 		}
 	}
@@ -147,29 +380,42 @@ func (c *Client) CallWithOptions(serviceMethod string, args interface{}, ret int
 
 // Stream calls the specified method with the specified arguments for the plugin and returns the response body
 func (c *Client) Stream(serviceMethod string, args interface{}) (io.ReadCloser, error) {
+	return c.StreamContext(context.Background(), serviceMethod, args)
+}
+
+// StreamContext is like Stream, but takes a context that cancels the
+// plugin request - including any retries - when the caller's own
+// operation is cancelled or times out.
+func (c *Client) StreamContext(ctx context.Context, serviceMethod string, args interface{}) (io.ReadCloser, error) {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(args); err != nil {
 		return nil, err
 	}
-	return c.callWithRetry(serviceMethod, &buf, true)
+	return c.callWithRetry(ctx, serviceMethod, &buf, true)
 }
 
 // SendFile calls the specified method, and passes through the IO stream
 func (c *Client) SendFile(serviceMethod string, data io.Reader, ret interface{}) error {
-	body, err := c.callWithRetry(serviceMethod, data, true)
+	return c.SendFileContext(context.Background(), serviceMethod, data, ret)
+}
+
+// SendFileContext is like SendFile, but takes a context that cancels the
+// plugin request - including any retries - when the caller's own
+// operation is cancelled or times out.
+func (c *Client) SendFileContext(ctx context.Context, serviceMethod string, data io.Reader, ret interface{}) error {
+	body, err := c.callWithRetry(ctx, serviceMethod, data, true)
 	if err != nil {
 		return err
 	}
 	defer body.Close()
 	if err := json.NewDecoder(body).Decode(&ret); err != nil {
-		log.G(context.TODO()).Errorf("%s: error reading plugin resp: %v", serviceMethod, err)
+		log.G(ctx).Errorf("%s: error reading plugin resp: %v", serviceMethod, err)
 		return err
 	}
 	return nil
 }
 
-func (c *Client) callWithRetry(serviceMethod string, data io.Reader, retry bool, reqOpts ...func(*RequestOpts)) (io.ReadCloser, error) {
-	var retries int
+func (c *Client) callWithRetry(ctx context.Context, serviceMethod string, data io.Reader, retry bool, reqOpts ...func(*RequestOpts)) (io.ReadCloser, error) {
 	start := time.Now()
 
 	var opts RequestOpts
@@ -177,17 +423,51 @@ func (c *Client) callWithRetry(serviceMethod string, data io.Reader, retry bool,
 		o(&opts)
 	}
 
+	// The request body must be re-readable on every iteration of the loop
+	// below: a transport error, a retryable status, and the
+	// compressed-to-uncompressed fallback on 415 all re-issue the same
+	// request from scratch. Buffer data once up front so each iteration
+	// gets its own fresh reader instead of re-reading (and draining) the
+	// original, which would otherwise send an empty body on any retry.
+	raw, err := io.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+
+	retryCfg := defaultRetryConfig
+	switch {
+	case opts.RetryConfig != nil:
+		retryCfg = *opts.RetryConfig
+	case c.retryConfig != nil:
+		retryCfg = *c.retryConfig
+	}
+	if opts.testTimeOut > 0 {
+		retryCfg.MaxElapsedTime = opts.testTimeOut
+	}
+	rb := &retryBackoff{cfg: retryCfg, start: start}
+
 	for {
-		req, err := c.requestFactory.NewRequest(serviceMethod, data)
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("plugin: %s: %w", serviceMethod, err)
+		}
+
+		req, err := c.requestFactory.NewRequest(serviceMethod, bytes.NewReader(raw))
 		if err != nil {
 			return nil, err
 		}
-
+		reqCtx := ctx
 		cancelRequest := func() {}
 		if opts.Timeout > 0 {
-			var ctx context.Context
-			ctx, cancelRequest = context.WithTimeout(req.Context(), opts.Timeout)
-			req = req.WithContext(ctx)
+			reqCtx, cancelRequest = context.WithTimeout(ctx, opts.Timeout)
+		}
+		reqCtx = context.WithValue(reqCtx, ServiceMethodContextKey, serviceMethod)
+		reqCtx = context.WithValue(reqCtx, PluginAddrContextKey, c.addr)
+		req = req.WithContext(reqCtx)
+
+		compressed := c.compression == CompressionGzip && !c.isCompressionUnsupported(serviceMethod)
+		if err := c.prepareRequestCompression(req, compressed); err != nil {
+			cancelRequest()
+			return nil, err
 		}
 
 		resp, err := c.http.Do(req)
@@ -196,69 +476,208 @@ func (c *Client) callWithRetry(serviceMethod string, data io.Reader, retry bool,
 			if !retry {
 				return nil, err
 			}
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, fmt.Errorf("plugin: %s: %w", serviceMethod, ctxErr)
+			}
 
-			timeOff := backoff(retries)
-			if abort(start, timeOff, opts.testTimeOut) {
+			delay, stop := rb.next(0)
+			if stop {
 				return nil, err
 			}
-			retries++
-			log.G(context.TODO()).Warnf("Unable to connect to plugin: %s%s: %v, retrying in %v", req.URL.Host, req.URL.Path, err, timeOff)
-			time.Sleep(timeOff)
+			log.G(ctx).Warnf("Unable to connect to plugin: %s%s: %v, retrying in %v", req.URL.Host, req.URL.Path, err, delay)
+			if err := sleepOrDone(ctx, delay); err != nil {
+				return nil, fmt.Errorf("plugin: %s: %w", serviceMethod, err)
+			}
 			continue
 		}
 
 		if resp.StatusCode != http.StatusOK {
-			b, err := io.ReadAll(resp.Body)
+			b, readErr := io.ReadAll(resp.Body)
 			resp.Body.Close()
 			cancelRequest()
-			if err != nil {
-				return nil, &statusError{resp.StatusCode, serviceMethod, err.Error()}
+
+			var lastErr error
+			if readErr != nil {
+				lastErr = &statusError{resp.StatusCode, serviceMethod, readErr.Error()}
+			} else {
+				lastErr = statusErrorFromBody(resp.StatusCode, serviceMethod, b)
 			}
 
-			// Plugins' Response(s) should have an Err field indicating what went
-			// wrong. Try to unmarshal into ResponseErr. Otherwise fallback to just
-			// return the string(body)
-			type responseErr struct {
-				Err string
+			// Plugins that don't support a gzip-compressed request
+			// body are expected to answer 415; remember that and
+			// retry once, uncompressed, without spending a backoff
+			// slot or counting against MaxElapsedTime.
+			if compressed && resp.StatusCode == http.StatusUnsupportedMediaType {
+				c.markCompressionUnsupported(serviceMethod)
+				log.G(ctx).Debugf("plugin %s%s does not support gzip-compressed requests, falling back to uncompressed", req.URL.Host, req.URL.Path)
+				continue
 			}
-			remoteErr := responseErr{}
-			if err := json.Unmarshal(b, &remoteErr); err == nil {
-				if remoteErr.Err != "" {
-					return nil, &statusError{resp.StatusCode, serviceMethod, remoteErr.Err}
+
+			if retry && isRetryableStatus(retryCfg.RetryableStatuses, resp.StatusCode) && ctx.Err() == nil {
+				retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+				delay, stop := rb.next(retryAfter)
+				if !stop {
+					log.G(ctx).Warnf("plugin %s%s returned %d, retrying in %v: %v", req.URL.Host, req.URL.Path, resp.StatusCode, delay, lastErr)
+					if err := sleepOrDone(ctx, delay); err == nil {
+						continue
+					}
 				}
 			}
-			// old way...
-			return nil, &statusError{resp.StatusCode, serviceMethod, string(b)}
+			return nil, lastErr
+		}
+
+		body := io.ReadCloser(resp.Body)
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			gzBody, err := newGzipReadCloser(resp.Body)
+			if err != nil {
+				resp.Body.Close()
+				cancelRequest()
+				return nil, err
+			}
+			body = gzBody
 		}
-		return ioutils.NewReadCloserWrapper(resp.Body, func() error {
-			err := resp.Body.Close()
+		return ioutils.NewReadCloserWrapper(body, func() error {
+			err := body.Close()
 			cancelRequest()
 			return err
 		}), nil
 	}
 }
 
-func backoff(retries int) time.Duration {
-	b, maxTimeout := 1*time.Second, defaultTimeOut
-	for b < maxTimeout && retries > 0 {
-		b *= 2
-		retries--
+// prepareRequestCompression advertises Accept-Encoding: gzip on req and,
+// if compress is true and req has a body, gzip-compresses it in place
+// and sets Content-Encoding: gzip.
+func (c *Client) prepareRequestCompression(req *http.Request, compress bool) error {
+	req.Header.Set("Accept-Encoding", "gzip")
+	if !compress || req.Body == nil {
+		return nil
+	}
+
+	raw, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	gzipped, err := gzipCompress(raw)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(gzipped))
+	req.ContentLength = int64(len(gzipped))
+	req.Header.Set("Content-Encoding", "gzip")
+	return nil
+}
+
+// sleepOrDone waits for d, returning nil, or returns ctx.Err() early if
+// ctx is done first.
+func sleepOrDone(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// statusErrorFromBody builds the error returned for a non-200 plugin
+// response. Plugins' Response(s) should have an Err field indicating
+// what went wrong; try to unmarshal into responseErr, otherwise fall
+// back to just returning the string(body).
+func statusErrorFromBody(statusCode int, serviceMethod string, b []byte) error {
+	type responseErr struct {
+		Err string
 	}
-	if b > maxTimeout {
-		b = maxTimeout
+	remoteErr := responseErr{}
+	if err := json.Unmarshal(b, &remoteErr); err == nil && remoteErr.Err != "" {
+		return &statusError{statusCode, serviceMethod, remoteErr.Err}
+	}
+	// old way...
+	return &statusError{statusCode, serviceMethod, string(b)}
+}
+
+func isRetryableStatus(statuses []int, code int) bool {
+	for _, s := range statuses {
+		if s == code {
+			return true
+		}
 	}
-	return b
+	return false
 }
 
 // testNonExistingPlugin is a special plugin-name, which overrides defaultTimeOut in tests.
 const testNonExistingPlugin = "this-plugin-does-not-exist"
 
-func abort(start time.Time, timeOff time.Duration, overrideTimeout time.Duration) bool {
-	to := defaultTimeOut
-	if overrideTimeout > 0 {
-		to = overrideTimeout
+// retryBackoff computes successive retry delays for one callWithRetry
+// loop, per the RetryConfig it was built from.
+type retryBackoff struct {
+	cfg      RetryConfig
+	start    time.Time
+	interval time.Duration
+}
+
+// next returns the delay before the next retry attempt, and whether the
+// loop should stop instead because the delay would push elapsed time
+// since start past cfg.MaxElapsedTime. retryAfter, if non-zero,
+// overrides the computed delay - clamped to cfg.MaxInterval - with a
+// duration honored from the plugin's Retry-After response header.
+func (b *retryBackoff) next(retryAfter time.Duration) (delay time.Duration, stop bool) {
+	if b.interval == 0 {
+		b.interval = b.cfg.InitialInterval
+	} else {
+		b.interval = time.Duration(float64(b.interval) * b.cfg.Multiplier)
+	}
+	if b.interval > b.cfg.MaxInterval {
+		b.interval = b.cfg.MaxInterval
+	}
+
+	delay = jitter(b.interval, b.cfg.RandomizationFactor)
+	if retryAfter > 0 {
+		delay = retryAfter
+		if delay > b.cfg.MaxInterval {
+			delay = b.cfg.MaxInterval
+		}
+	}
+
+	if time.Since(b.start)+delay >= b.cfg.MaxElapsedTime {
+		return 0, true
+	}
+	return delay, false
+}
+
+// jitter returns interval randomized uniformly in
+// [interval*(1-randomizationFactor), interval*(1+randomizationFactor)].
+// A randomizationFactor <= 0 disables jitter.
+func jitter(interval time.Duration, randomizationFactor float64) time.Duration {
+	if randomizationFactor <= 0 {
+		return interval
+	}
+	delta := randomizationFactor * float64(interval)
+	lo, hi := float64(interval)-delta, float64(interval)+delta
+	return time.Duration(lo + rand.Float64()*(hi-lo))
+}
+
+// parseRetryAfter parses an HTTP Retry-After header value, which is
+// either an integer number of seconds or an HTTP date, returning 0 if h
+// is empty or unparseable.
+func parseRetryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
 	}
-	return timeOff+time.Since(start) >= to
+	return 0
 }
 
 func httpScheme(u *url.URL) string {
@@ -0,0 +1,126 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// fakeRequestFactory builds a plain *http.Request against a fixed base URL,
+// standing in for transport.HTTPTransport so callWithRetry can be exercised
+// without a real plugin transport.
+type fakeRequestFactory struct {
+	base string
+}
+
+func (f *fakeRequestFactory) NewRequest(path string, data io.Reader) (*http.Request, error) {
+	return http.NewRequest(http.MethodPost, f.base+path, data)
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server) *Client {
+	t.Helper()
+	return &Client{
+		http:           srv.Client(),
+		requestFactory: &fakeRequestFactory{base: srv.URL},
+	}
+}
+
+// TestCallWithRetryGzipFallbackResendsBody is a regression test for a bug
+// where callWithRetry built the *http.Request from the same io.Reader on
+// every loop iteration: prepareRequestCompression drained it compressing
+// the first attempt, so the uncompressed retry after a 415 sent an empty
+// body instead of the original request.
+func TestCallWithRetryGzipFallbackResendsBody(t *testing.T) {
+	type payload struct {
+		Msg string `json:"msg"`
+	}
+
+	var calls atomic.Int32
+	var lastUncompressedBody []byte
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if n == 1 {
+			// Reject the first (compressed) attempt so the client falls
+			// back to uncompressed for the retry.
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		assert.NilError(t, err)
+		lastUncompressedBody = body
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	c.compression = CompressionGzip
+
+	var ret map[string]any
+	err := c.CallContext(context.Background(), "/fake.Method", payload{Msg: "hello"}, &ret)
+	assert.NilError(t, err)
+
+	assert.Equal(t, calls.Load(), int32(2))
+	assert.Assert(t, len(lastUncompressedBody) > 0, "retry must resend the original body, not an empty one")
+
+	var got payload
+	assert.NilError(t, json.Unmarshal(lastUncompressedBody, &got))
+	assert.Equal(t, got.Msg, "hello")
+}
+
+// TestCallWithRetryRetryableStatusResendsBody checks that a plain
+// retryable-status retry (no compression involved) also resends the
+// original body on every attempt.
+func TestCallWithRetryRetryableStatusResendsBody(t *testing.T) {
+	type payload struct {
+		Msg string `json:"msg"`
+	}
+
+	var calls atomic.Int32
+	bodies := make(chan []byte, 2)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NilError(t, err)
+		bodies <- body
+
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	c.retryConfig = &RetryConfig{
+		InitialInterval:   time.Millisecond,
+		MaxInterval:       10 * time.Millisecond,
+		MaxElapsedTime:    time.Second,
+		Multiplier:        2,
+		RetryableStatuses: []int{http.StatusServiceUnavailable},
+	}
+
+	var ret map[string]any
+	err := c.CallContext(context.Background(), "/fake.Method", payload{Msg: "world"}, &ret)
+	assert.NilError(t, err)
+	assert.Equal(t, calls.Load(), int32(2))
+
+	close(bodies)
+	for body := range bodies {
+		var got payload
+		assert.NilError(t, json.Unmarshal(body, &got))
+		assert.Equal(t, got.Msg, "world")
+	}
+}
@@ -0,0 +1,52 @@
+// Package pluginmetrics provides a ready-made plugins.Client
+// RoundTripper middleware that records call latency to Prometheus.
+package pluginmetrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/moby/moby/v2/pkg/plugins"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewPrometheusRoundTripper returns middleware, for use with
+// plugins.WithRoundTripper, that records the duration of every plugin
+// HTTP call as plugin_call_duration_seconds{method,plugin,status} on
+// reg. method and plugin are read from the request context's
+// plugins.ServiceMethodContextKey/PluginAddrContextKey, set by
+// plugins.Client on every outgoing request; status is the response's
+// HTTP status code, or "error" if the round trip failed outright.
+func NewPrometheusRoundTripper(reg prometheus.Registerer) func(http.RoundTripper) http.RoundTripper {
+	hist := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "plugin_call_duration_seconds",
+		Help: "Duration of HTTP calls made to Docker plugins.",
+	}, []string{"method", "plugin", "status"})
+	reg.MustRegister(hist)
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+
+			status := "error"
+			if err == nil {
+				status = strconv.Itoa(resp.StatusCode)
+			}
+			method, _ := req.Context().Value(plugins.ServiceMethodContextKey).(string)
+			addr, _ := req.Context().Value(plugins.PluginAddrContextKey).(string)
+			hist.WithLabelValues(method, addr, status).Observe(time.Since(start).Seconds())
+
+			return resp, err
+		})
+	}
+}
+
+// roundTripperFunc adapts a function to the http.RoundTripper interface,
+// the way http.HandlerFunc does for http.Handler.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}